@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditBufferSize is how many audit entries may wait to be written before new ones are dropped.
+const auditBufferSize = 1024
+
+// audit writes the -audit-log, nil when it is not set.
+var audit *auditLogger
+
+// auditEntry is a line of the audit log, written for each pod patch the API server accepted.
+type auditEntry struct {
+	Time       time.Time       `json:"time"`
+	Namespace  string          `json:"namespace"`
+	Pod        string          `json:"pod"`
+	Containers []string        `json:"containers"`
+	PatchType  string          `json:"patchType"`
+	Patch      json.RawMessage `json:"patch"`
+}
+
+// auditLogger appends JSON lines to the audit log file from its own goroutine, so a slow disk never holds up
+// the pods. When the buffer is full the entry is dropped and counted in the audit dropped metric rather than waited for.
+type auditLogger struct {
+	path    string
+	file    *os.File
+	entries chan auditEntry
+	reopens chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newAuditLogger opens the audit log file for appending, creating it when it doesn't exist.
+func newAuditLogger(path string) (*auditLogger, error) {
+	file, err := openAuditLog(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &auditLogger{
+		path:    path,
+		file:    file,
+		entries: make(chan auditEntry, auditBufferSize),
+		reopens: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func openAuditLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// log queues the entry without blocking. It does nothing on a nil or closed logger.
+func (l *auditLogger) log(e auditEntry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		auditDropped.Inc()
+		slog.Warn("Audit log buffer is full, dropping the entry", "pod", e.Pod, "namespace", e.Namespace)
+	}
+}
+
+// reopen makes the writer reopen the file, e.g. on SIGHUP after logrotate moved it.
+func (l *auditLogger) reopen() {
+	if l == nil {
+		return
+	}
+	select {
+	case l.reopens <- struct{}{}:
+	default:
+	}
+}
+
+// close writes the queued entries and closes the file.
+func (l *auditLogger) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.entries)
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+func (l *auditLogger) run() {
+	defer close(l.done)
+	for {
+		select {
+		case e, ok := <-l.entries:
+			if !ok {
+				l.file.Close()
+				return
+			}
+			l.write(e)
+		case <-l.reopens:
+			l.reopenFile()
+		}
+	}
+}
+
+func (l *auditLogger) write(e auditEntry) {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Encoding the audit log entry failed", "pod", e.Pod, "namespace", e.Namespace, "error", err)
+		return
+	}
+	if _, err := l.file.Write(append(bs, '\n')); err != nil {
+		slog.Error("Writing the audit log failed", "path", l.path, "pod", e.Pod, "namespace", e.Namespace, "error", err)
+	}
+}
+
+// reopenFile swaps in a freshly opened file, keeping the current one when the path can not be opened.
+func (l *auditLogger) reopenFile() {
+	file, err := openAuditLog(l.path)
+	if err != nil {
+		slog.Error("Reopening the audit log failed, keeping the current file", "path", l.path, "error", err)
+		return
+	}
+	l.file.Close()
+	l.file = file
+	slog.Info("Reopened the audit log", "path", l.path)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"unicode"
+
+	"github.com/ghodss/yaml"
+)
+
+// mergeConfigData merges the YAML configs into a single JSON config, in order. A key set by a later config
+// overrides the same key of an earlier one, objects are merged key by key and lists are concatenated,
+// dropping items equal to an earlier item. The result is parsed like a single config.
+func mergeConfigData(datas [][]byte) ([]byte, error) {
+	merged := map[string]interface{}{}
+	for i, bs := range datas {
+		data, err := yaml.YAMLToJSON(bs)
+		if err != nil {
+			return nil, fmt.Errorf("config %d: %w", i, err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("config %d: invalid config: %w", i, err)
+		}
+		merged = mergeObjects(merged, m)
+	}
+	return json.Marshal(merged)
+}
+
+// configYAML returns the config as YAML, with the same lowerCamel keys the config is read from.
+func configYAML(c *config) ([]byte, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	// Only the keys of config and NamespaceConfig are Go field names, the API types have json tags.
+	m = lowerCamelKeys(m)
+	if overrides, ok := m["namespaceOverrides"].(map[string]interface{}); ok {
+		for ns, o := range overrides {
+			if o, ok := o.(map[string]interface{}); ok {
+				overrides[ns] = lowerCamelKeys(o)
+			}
+		}
+	}
+	return yaml.Marshal(m)
+}
+
+func lowerCamelKeys(m map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range m {
+		out[lowerCamel(k)] = v
+	}
+	return out
+}
+
+// lowerCamel lowercases the leading upper case letters of the name, keeping the last one of an
+// initialism before a lower case letter, so "APIVersion" becomes "apiVersion".
+func lowerCamel(name string) string {
+	rs := []rune(name)
+	for i := range rs {
+		if !unicode.IsUpper(rs[i]) {
+			break
+		}
+		if i > 0 && i+1 < len(rs) && unicode.IsLower(rs[i+1]) {
+			break
+		}
+		rs[i] = unicode.ToLower(rs[i])
+	}
+	return string(rs)
+}
+
+func mergeObjects(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		dst[k] = mergeValues(dst[k], v)
+	}
+	return dst
+}
+
+func mergeValues(dst, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[string]interface{}:
+		if d, ok := dst.(map[string]interface{}); ok {
+			return mergeObjects(d, s)
+		}
+	case []interface{}:
+		if d, ok := dst.([]interface{}); ok {
+			for _, v := range s {
+				if !containsValue(d, v) {
+					d = append(d, v)
+				}
+			}
+			return d
+		}
+	}
+	return src
+}
+
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
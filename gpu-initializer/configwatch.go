@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// configStore holds the latest config, so it can be swapped while pods are being initialized.
+type configStore struct {
+	v atomic.Value
+}
+
+func (s *configStore) Load() *config {
+	return s.v.Load().(*config)
+}
+
+func (s *configStore) Store(c *config) {
+	s.v.Store(c)
+}
+
+// configmapNames returns the configmaps given by -configmaps, or the -configmap when it is empty.
+func configmapNames() []string {
+	names := splitList(configmaps)
+	if len(names) == 0 {
+		return []string{configmap}
+	}
+	return names
+}
+
+// loadConfig loads the config from -config-file, or from the configmaps when no file is given.
+// Several configmaps are merged in order, see mergeConfigData.
+func loadConfig(ctx context.Context, clientset kubernetes.Interface) (*config, error) {
+	if configFile != "" {
+		bs, err := ioutil.ReadFile(configFile)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: config file %s does not exist", ErrConfigMissing, configFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c, err := parseConfig(bs)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: %w", configFile, err)
+		}
+		return c, nil
+	}
+
+	names := configmapNames()
+	if len(names) == 1 {
+		cm, err := getConfigMap(ctx, clientset, names[0])
+		if err != nil {
+			return nil, err
+		}
+		return configmapToConfig(cm)
+	}
+
+	datas := [][]byte{}
+	for _, name := range names {
+		cm, err := getConfigMap(ctx, clientset, name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := configmapData(cm)
+		if err != nil {
+			return nil, err
+		}
+		datas = append(datas, data)
+	}
+	merged, err := mergeConfigData(datas)
+	if err != nil {
+		return nil, fmt.Errorf("merging configmaps %v: %w", names, err)
+	}
+	c, err := parseConfig(merged)
+	if err != nil {
+		return nil, fmt.Errorf("merged configmaps %v: %w", names, err)
+	}
+	return c, nil
+}
+
+func getConfigMap(ctx context.Context, clientset kubernetes.Interface, name string) (*corev1.ConfigMap, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: configmap %s/%s not found", ErrConfigMissing, namespace, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting configmap %s/%s: %w", namespace, name, err)
+	}
+	return cm, nil
+}
+
+// validateConfigFile loads the -config-file for -validate-only, printing OK or the error, and returns the exit code.
+// With -print-config the effective config is printed too.
+func validateConfigFile() int {
+	if configFile == "" {
+		fmt.Fprintln(os.Stderr, "-validate-only requires -config-file")
+		return 2
+	}
+	c, err := loadConfig(context.Background(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if printConfig {
+		bs, err := configYAML(c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Print(string(bs))
+	}
+	fmt.Println("OK")
+	return 0
+}
+
+// reloadConfig reloads the config on SIGHUP. On failure the current config is kept.
+func reloadConfig(ctx context.Context, clientset kubernetes.Interface, store *configStore) {
+	c, err := loadConfig(ctx, clientset)
+	if err != nil {
+		configErrors.Inc()
+		slog.Error("Keeping the current config, failed to reload it", "error", err)
+		return
+	}
+	store.Store(c)
+	slog.Info("Reloaded config on SIGHUP")
+}
+
+// watchConfigMap keeps the store up to date with the configmap until the context is cancelled. When the config
+// is merged from several configmaps, a change to one of them reloads all of them.
+// When the configmap can not be loaded or is deleted, the last known good config is kept.
+// The watch uses watchClientset, as it outlives the -api-timeout of clientset.
+func watchConfigMap(ctx context.Context, clientset, watchClientset kubernetes.Interface, namespace, name string, store *configStore) {
+	watchlist := cache.NewListWatchFromClient(watchClientset.CoreV1().RESTClient(), "configmaps", namespace, fields.OneTermEqualSelector("metadata.name", name))
+
+	reload := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+		var c *config
+		var err error
+		if len(configmapNames()) == 1 {
+			c, err = configmapToConfig(cm)
+		} else {
+			c, err = loadConfig(ctx, clientset)
+		}
+		if err != nil {
+			configErrors.Inc()
+			slog.Error("Keeping the current config, failed to load configmap", "namespace", namespace, "configmap", name, "error", err)
+			return
+		}
+		store.Store(c)
+		slog.Info("Loaded config from configmap", "namespace", namespace, "configmap", name)
+	}
+
+	_, controller := cache.NewInformer(watchlist, &corev1.ConfigMap{}, 0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: reload,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				reload(newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				slog.Warn("Configmap was deleted, keeping the last known good config", "namespace", namespace, "configmap", name)
+			},
+		},
+	)
+	controller.Run(ctx.Done())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func newTestConfigMap(name, data string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Data:       map[string]string{defaultConfigmapKey: data},
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	const invalid = "ignoreNamespaces: [\"\"]"
+
+	tests := []struct {
+		name       string
+		configFile string
+		configmaps string
+		objects    []runtime.Object
+		wantField  string
+		wantMiss   bool
+	}{
+		{
+			name:       "invalid config file",
+			configFile: invalid,
+			wantField:  "ignoreNamespaces[0]",
+		},
+		{
+			name:      "invalid configmap",
+			objects:   []runtime.Object{newTestConfigMap(defaultConfigmap, invalid)},
+			wantField: "ignoreNamespaces[0]",
+		},
+		{
+			name:       "invalid merged configmaps",
+			configmaps: "base,override",
+			objects:    []runtime.Object{newTestConfigMap("base", "injectEnvValue: void"), newTestConfigMap("override", invalid)},
+			wantField:  "ignoreNamespaces[0]",
+		},
+		{
+			name:     "missing configmap",
+			wantMiss: true,
+		},
+		{
+			name:       "missing merged configmap",
+			configmaps: "base,override",
+			objects:    []runtime.Object{newTestConfigMap("base", "injectEnvValue: void")},
+			wantMiss:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.configFile != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := ioutil.WriteFile(path, []byte(tt.configFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+				setFlag(t, &configFile, path)
+			}
+			setFlag(t, &configmaps, tt.configmaps)
+
+			_, err := loadConfig(context.Background(), newTestClientset(tt.objects...))
+			if err == nil {
+				t.Fatal("loadConfig() succeeded, want an error")
+			}
+			var validationErr *ValidationError
+			if tt.wantField != "" && (!errors.As(err, &validationErr) || validationErr.Field != tt.wantField) {
+				t.Errorf("loadConfig() error = %v, want a ValidationError of %s", err, tt.wantField)
+			}
+			if errors.Is(err, ErrConfigMissing) != tt.wantMiss {
+				t.Errorf("loadConfig() error = %v, errors.Is(err, ErrConfigMissing) = %v, want %v", err, !tt.wantMiss, tt.wantMiss)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// podController initializes the uninitialized pods. The informers queue the keys of the pods they see
+// in a rate limited workqueue, so a pod that fails is retried with backoff rather than at the next resync,
+// up to -max-retries times. A throttled pod waits at least the delay the API server suggested, a rejected
+// patch is not retried. One informer runs per watched namespace, so namespace scoped Roles are enough
+// when -watch-namespaces is set.
+type podController struct {
+	ctx       context.Context
+	clientset kubernetes.Interface
+	store     *configStore
+	recorder  record.EventRecorder
+	inflight  *inflightTracker
+
+	// The rate limiter of the queue also gives the backoff of the throttled pods.
+	queue       workqueue.RateLimitingInterface
+	rateLimiter workqueue.RateLimiter
+	informers   []cache.Controller
+	// The informer caches by watched namespace, corev1.NamespaceAll when watching all namespaces.
+	indexers map[string]cache.Indexer
+}
+
+// newPodController returns the controller initializing the uninitialized pods in the namespaces,
+// corev1.NamespaceAll for all namespaces. The informers use watchClientset, as a watch outlives the
+// -api-timeout of the clientset initializing the pods.
+func newPodController(ctx context.Context, clientset, watchClientset kubernetes.Interface, namespaces []string, store *configStore, recorder record.EventRecorder, inflight *inflightTracker) *podController {
+	rateLimiter := workqueue.DefaultControllerRateLimiter()
+	pc := &podController{
+		ctx:         ctx,
+		clientset:   clientset,
+		store:       store,
+		recorder:    recorder,
+		inflight:    inflight,
+		queue:       workqueue.NewNamedRateLimitingQueue(rateLimiter, "pods"),
+		rateLimiter: rateLimiter,
+		indexers:    map[string]cache.Indexer{},
+	}
+	for _, ns := range namespaces {
+		indexer, informer := newPodInformer(watchClientset, ns, pc.enqueue)
+		pc.indexers[ns] = indexer
+		pc.informers = append(pc.informers, informer)
+	}
+	return pc
+}
+
+// newPodInformer returns the informer watching the uninitialized Pods in the namespace.
+func newPodInformer(clientset kubernetes.Interface, namespace string, enqueue func(obj interface{})) (cache.Indexer, cache.Controller) {
+	// Set the `IncludeUninitialized` list option on both the list and the watch calls,
+	// uninitialized pods are left out otherwise.
+	includeUninitializedWatchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.IncludeUninitialized = true
+			return clientset.CoreV1().Pods(namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.IncludeUninitialized = true
+			return clientset.CoreV1().Pods(namespace).Watch(options)
+		},
+	}
+
+	period := jitteredResyncPeriod(resyncPeriod, resyncJitter)
+	slog.Debug("Pod informer resync period", "namespace", namespace, "resync-period", period)
+	return cache.NewIndexerInformer(includeUninitializedWatchlist, &corev1.Pod{}, period,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: enqueue,
+			// A pod becomes ours once the initializers before us removed themselves, which is an update.
+			// Resyncs are updates too. initializePod leaves pods we are not first pending on alone,
+			// so handling a pod again is a no-op.
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				enqueue(newObj)
+			},
+		},
+		cache.Indexers{},
+	)
+}
+
+// jitteredResyncPeriod returns a random period within ±jitter of the base period, so replicas and restarts
+// don't resync in lockstep. The informer keeps the period, it is drawn once per informer.
+func jitteredResyncPeriod(period time.Duration, jitter float64) time.Duration {
+	return time.Duration(float64(period) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+func (pc *podController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		slog.Error("Skipping an object without a key", "type", fmt.Sprintf("%T", obj), "error", err)
+		return
+	}
+	pc.queue.Add(key)
+}
+
+// Run runs the informers and -workers workers until stop is closed. The queue never hands the same pod
+// to two workers at once, and pods don't depend on each other, so they can be initialized in any order.
+// Once stop is closed the queue is shut down, the workers finish the pod at hand and exit.
+func (pc *podController) Run(stop <-chan struct{}) {
+	defer pc.queue.ShutDown()
+
+	for _, informer := range pc.informers {
+		go informer.Run(stop)
+	}
+	if !cache.WaitForCacheSync(stop, pc.HasSynced) {
+		return
+	}
+	for i := 0; i < workers; i++ {
+		go wait.Until(pc.runWorker, time.Second, stop)
+	}
+	<-stop
+}
+
+// HasSynced reports whether all the informers have synced.
+func (pc *podController) HasSynced() bool {
+	for _, informer := range pc.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (pc *podController) runWorker() {
+	for pc.processNextItem() {
+	}
+}
+
+// processNextItem initializes the next queued pod, requeueing it with backoff when it fails.
+// It returns false once the queue is shut down.
+func (pc *podController) processNextItem() bool {
+	item, shutdown := pc.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer pc.queue.Done(item)
+	key := item.(string)
+
+	pc.inflight.start()
+	defer pc.inflight.done()
+
+	obj, exists, err := pc.getPod(key)
+	if err != nil || !exists {
+		// The pod was deleted since it was queued.
+		pc.queue.Forget(item)
+		return true
+	}
+
+	err = handlePod(pc.ctx, obj, pc.store.Load(), pc.clientset, pc.recorder)
+	if err == nil {
+		pc.queue.Forget(item)
+		return true
+	}
+	var patchErr *PatchError
+	if errors.As(err, &patchErr) && patchErr.Permanent() {
+		slog.Error("Initializing pod failed, the patch was rejected", "pod", key, "error", err)
+		pc.queue.Forget(item)
+		return true
+	}
+	if pc.queue.NumRequeues(item) < maxRetries {
+		slog.Warn("Initializing pod failed, requeueing", "pod", key, "retries", pc.queue.NumRequeues(item), "error", err)
+		// The rate limiter counts the requeue either way, so throttled pods share the -max-retries budget.
+		var throttledErr *throttledError
+		if errors.As(err, &throttledErr) {
+			delay := pc.rateLimiter.When(item)
+			if throttledErr.delay > delay {
+				delay = throttledErr.delay
+			}
+			pc.queue.AddAfter(item, delay)
+		} else {
+			pc.queue.AddRateLimited(item)
+		}
+		return true
+	}
+	slog.Error("Initializing pod failed, giving up", "pod", key, "retries", maxRetries, "error", err)
+	pc.queue.Forget(item)
+	return true
+}
+
+// getPod returns the pod of the key from the cache of the informer watching its namespace.
+func (pc *podController) getPod(key string) (interface{}, bool, error) {
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	indexer, ok := pc.indexers[namespace]
+	if !ok {
+		indexer = pc.indexers[corev1.NamespaceAll]
+	}
+	return indexer.GetByKey(key)
+}
+
+// handlePod initializes the pod given by the informer. It never panics, since a panic would
+// kill the worker goroutine and silently stop all initialization.
+func handlePod(ctx context.Context, obj interface{}, c *config, clientset kubernetes.Interface, recorder record.EventRecorder) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Recovered from a panic while initializing pod", "panic", r)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		slog.Error("Skipping an object that is not a pod", "type", fmt.Sprintf("%T", obj))
+		return nil
+	}
+	return initializePod(ctx, pod, c, clientset, recorder)
+}
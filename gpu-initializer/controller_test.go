@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// watchStarted returns a channel closed once the first pod watch of the clientset is set up. The fake
+// clientset holds its lock while setting up the watch, so a request made after the channel is closed
+// is seen by the watch.
+func watchStarted(clientset *fake.Clientset) <-chan struct{} {
+	started := make(chan struct{})
+	var once sync.Once
+	clientset.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		once.Do(func() { close(started) })
+		return false, nil, nil
+	})
+	return started
+}
+
+// runTestController runs the controller for the pods of all the namespaces until the test ends.
+func runTestController(t *testing.T, clientset *fake.Clientset, c *config) {
+	t.Helper()
+	store := &configStore{}
+	store.Store(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := newPodController(ctx, clientset, clientset, []string{corev1.NamespaceAll}, store, record.NewFakeRecorder(100), &inflightTracker{})
+
+	done := make(chan struct{})
+	go func() {
+		pc.Run(ctx.Done())
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForPod waits until the stored pod meets the condition, failing the test after a few seconds.
+func waitForPod(t *testing.T, clientset *fake.Clientset, pod *corev1.Pod, condition func(pod *corev1.Pod) bool) *corev1.Pod {
+	t.Helper()
+	var got *corev1.Pod
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		got = getTestPod(t, clientset, pod)
+		return condition(got), nil
+	})
+	if err != nil {
+		t.Fatalf("pod %s/%s = %+v, did not reach the expected state: %v", pod.Namespace, pod.Name, got, err)
+	}
+	return got
+}
+
+func initialized(pod *corev1.Pod) bool {
+	return pod.Initializers == nil
+}
+
+// TestPodController runs the controller loop against a fake clientset. An envtest run isn't workable:
+// it needs a kube-apiserver of 1.14 or later, while Initializers were removed after 1.13.
+func TestPodController(t *testing.T) {
+	listed := newTestPod("listed", newTestContainer("app"))
+	gpu := newTestPod("gpu", newGpuContainer("cuda"))
+	waiting := newTestPod("waiting", newTestContainer("app"))
+	waiting.Initializers.Pending = []metav1.Initializer{{Name: "other.example.com"}, {Name: defaultInitializerName}}
+	clientset := newTestClientset(listed, gpu, waiting)
+	started := watchStarted(clientset)
+
+	runTestController(t, clientset, newTestConfig(t, ""))
+
+	// The pods there before the controller started are initialized from the initial list.
+	got := waitForPod(t, clientset, listed, initialized)
+	if v, _ := envValue(got, "app", defaultInjectEnvName); v != defaultInjectEnvValue {
+		t.Errorf("pod listed container app %s = %q, want %q", defaultInjectEnvName, v, defaultInjectEnvValue)
+	}
+	got = waitForPod(t, clientset, gpu, initialized)
+	if _, ok := envValue(got, "cuda", defaultInjectEnvName); ok {
+		t.Errorf("pod gpu container cuda has %s set", defaultInjectEnvName)
+	}
+
+	// A pod becomes ours when the initializers before us remove themselves, which the watch sees as an update.
+	<-started
+	waiting = getTestPod(t, clientset, waiting)
+	waiting.Initializers.Pending = waiting.Initializers.Pending[1:]
+	if _, err := clientset.CoreV1().Pods(waiting.Namespace).Update(waiting); err != nil {
+		t.Fatalf("removing the other initializer: %v", err)
+	}
+	got = waitForPod(t, clientset, waiting, initialized)
+	if v, _ := envValue(got, "app", defaultInjectEnvName); v != defaultInjectEnvValue {
+		t.Errorf("pod waiting container app %s = %q, want %q", defaultInjectEnvName, v, defaultInjectEnvValue)
+	}
+
+	// A pod created while the controller runs comes from the watch.
+	created := newTestPod("created", newTestContainer("app"))
+	if _, err := clientset.CoreV1().Pods(created.Namespace).Create(created); err != nil {
+		t.Fatalf("creating pod: %v", err)
+	}
+	got = waitForPod(t, clientset, created, initialized)
+	if v, _ := envValue(got, "app", defaultInjectEnvName); v != defaultInjectEnvValue {
+		t.Errorf("pod created container app %s = %q, want %q", defaultInjectEnvName, v, defaultInjectEnvValue)
+	}
+}
+
+func TestPodControllerThrottled(t *testing.T) {
+	setFlag(t, &maxRetries, 2)
+
+	tests := []struct {
+		name string
+		// The Retry-After seconds of the 429 responses.
+		retryAfter  int
+		wantPatches int
+	}{
+		{
+			name:        "gives up after -max-retries",
+			wantPatches: 3,
+		},
+		{
+			name:        "waits for the Retry-After delay",
+			retryAfter:  1,
+			wantPatches: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			clientset := newTestClientset(pod)
+			failPatches(clientset, -1, apierrors.NewTooManyRequests("throttled", tt.retryAfter))
+			store := &configStore{}
+			store.Store(newTestConfig(t, ""))
+			pc := newPodController(context.Background(), clientset, clientset, []string{corev1.NamespaceAll}, store, record.NewFakeRecorder(100), &inflightTracker{})
+			defer pc.queue.ShutDown()
+			if err := pc.indexers[corev1.NamespaceAll].Add(pod); err != nil {
+				t.Fatal(err)
+			}
+			key := testNamespace + "/" + pod.Name
+			pc.queue.Add(key)
+
+			start := time.Now()
+			for i := 0; i < tt.wantPatches; i++ {
+				pc.processNextItem()
+			}
+			if got := len(patchActions(clientset)); got != tt.wantPatches {
+				t.Errorf("the controller sent %d patches, want %d", got, tt.wantPatches)
+			}
+			if tt.retryAfter == 0 {
+				if pc.queue.Len() != 0 || pc.queue.NumRequeues(key) != 0 {
+					t.Errorf("the pod is still queued after -max-retries, %d requeues", pc.queue.NumRequeues(key))
+				}
+				return
+			}
+			if got := pc.queue.NumRequeues(key); got != 1 {
+				t.Errorf("throttled requeues = %d, want 1", got)
+			}
+			// The pod comes back once the Retry-After delay passed.
+			pc.processNextItem()
+			if delay := time.Since(start); delay < time.Duration(tt.retryAfter)*time.Second {
+				t.Errorf("the pod was requeued after %s, want at least %ds", delay, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestHandlePod(t *testing.T) {
+	tests := []struct {
+		name string
+		obj  interface{}
+		// A nil config makes the policy panic.
+		config      *config
+		wantErr     bool
+		wantPatched bool
+	}{
+		{
+			name:        "initializes a pod",
+			obj:         newTestPod("app", newTestContainer("app")),
+			config:      newTestConfig(t, ""),
+			wantPatched: true,
+		},
+		{
+			name:   "skips an object that is not a pod",
+			obj:    &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: testNamespace}},
+			config: newTestConfig(t, ""),
+		},
+		{
+			name:   "skips a tombstone",
+			obj:    cache.DeletedFinalStateUnknown{Key: testNamespace + "/app"},
+			config: newTestConfig(t, ""),
+		},
+		{
+			name:    "recovers from a panic",
+			obj:     newTestPod("app", newTestContainer("app")),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := newTestClientset(newTestPod("app", newTestContainer("app")))
+			err := handlePod(context.Background(), tt.obj, tt.config, clientset, record.NewFakeRecorder(10))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handlePod() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := len(patchActions(clientset)) > 0; got != tt.wantPatched {
+				t.Errorf("handlePod() patched the pod: %v, want %v", got, tt.wantPatched)
+			}
+		})
+	}
+}
+
+func TestJitteredResyncPeriod(t *testing.T) {
+	tests := []struct {
+		name   string
+		period time.Duration
+		jitter float64
+	}{
+		{name: "no jitter", period: 30 * time.Second},
+		{name: "10% jitter", period: 30 * time.Second, jitter: 0.1},
+		{name: "large jitter", period: time.Minute, jitter: 0.9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shortest := time.Duration(float64(tt.period) * (1 - tt.jitter))
+			longest := time.Duration(float64(tt.period) * (1 + tt.jitter))
+			seen := map[time.Duration]bool{}
+			for i := 0; i < 1000; i++ {
+				got := jitteredResyncPeriod(tt.period, tt.jitter)
+				if got < shortest || got > longest {
+					t.Fatalf("jitteredResyncPeriod(%s, %v) = %s, want within [%s, %s]", tt.period, tt.jitter, got, shortest, longest)
+				}
+				seen[got] = true
+			}
+			if tt.jitter == 0 && len(seen) != 1 {
+				t.Errorf("jitteredResyncPeriod() without jitter returned %d periods, want only %s", len(seen), tt.period)
+			}
+			if tt.jitter > 0 && len(seen) == 1 {
+				t.Errorf("jitteredResyncPeriod() with jitter %v always returned the same period", tt.jitter)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// The environment variables overriding config fields, e.g. where a ConfigMap is inconvenient.
+const (
+	envInjectEnvName    = "GPU_INITIALIZER_INJECT_ENV_NAME"
+	envInjectEnvValue   = "GPU_INITIALIZER_INJECT_ENV_VALUE"
+	envIgnoreNamespaces = "GPU_INITIALIZER_IGNORE_NAMESPACES"
+)
+
+// applyEnvOverrides sets the config fields given by the environment variables, before the config is validated
+// and defaulted, so the precedence is environment > config file or ConfigMap > defaults. The inject env value
+// variable also replaces the injectEnvValue of the namespaceOverrides. An unset or empty variable leaves its field alone. The ignore namespaces variable is a comma separated list replacing ignoreNamespaces.
+// The inject env variables would have no effect with injectEnvs set, so that is an error.
+func applyEnvOverrides(c *config, getenv func(string) string) error {
+	if len(c.InjectEnvs) > 0 {
+		for _, name := range []string{envInjectEnvName, envInjectEnvValue} {
+			if getenv(name) != "" {
+				return invalidField("injectEnvs", "can not be set together with %s, set the envs in injectEnvs instead", name)
+			}
+		}
+	}
+	if v := getenv(envInjectEnvName); v != "" {
+		slog.Debug("Config field set by the environment", "field", "injectEnvName", "env", envInjectEnvName)
+		c.InjectEnvName = v
+	}
+	if v := getenv(envInjectEnvValue); v != "" {
+		slog.Debug("Config field set by the environment", "field", "injectEnvValue", "env", envInjectEnvValue)
+		c.InjectEnvValue = v
+		// The variable takes precedence over the namespace overrides of the config too.
+		if c.NamespaceOverrides != nil {
+			overrides := map[string]NamespaceConfig{}
+			for ns, o := range c.NamespaceOverrides {
+				o.InjectEnvValue = ""
+				overrides[ns] = o
+			}
+			c.NamespaceOverrides = overrides
+		}
+	}
+	if v := getenv(envIgnoreNamespaces); v != "" {
+		slog.Debug("Config field set by the environment", "field", "ignoreNamespaces", "env", envIgnoreNamespaces)
+		c.IgnoreNamespaces = splitList(v)
+	}
+	return nil
+}
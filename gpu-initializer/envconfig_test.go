@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	injectEnvs := []corev1.EnvVar{{Name: defaultInjectEnvName, Value: "void"}}
+
+	tests := []struct {
+		name    string
+		config  config
+		env     map[string]string
+		want    config
+		wantErr bool
+	}{
+		{
+			name:   "no variables",
+			config: config{InjectEnvName: "GPUS", IgnoreNamespaces: []string{"a"}},
+			want:   config{InjectEnvName: "GPUS", IgnoreNamespaces: []string{"a"}},
+		},
+		{
+			name:   "variables override the config",
+			config: config{InjectEnvName: "GPUS", InjectEnvValue: "none", IgnoreNamespaces: []string{"a"}},
+			env:    map[string]string{envInjectEnvName: "NVIDIA_VISIBLE_DEVICES", envInjectEnvValue: "void", envIgnoreNamespaces: "b, c"},
+			want:   config{InjectEnvName: "NVIDIA_VISIBLE_DEVICES", InjectEnvValue: "void", IgnoreNamespaces: []string{"b", "c"}},
+		},
+		{
+			name:   "empty variables are ignored",
+			config: config{InjectEnvValue: "none"},
+			env:    map[string]string{envInjectEnvValue: ""},
+			want:   config{InjectEnvValue: "none"},
+		},
+		{
+			name:    "inject env value with injectEnvs",
+			config:  config{InjectEnvs: injectEnvs},
+			env:     map[string]string{envInjectEnvValue: "none"},
+			wantErr: true,
+		},
+		{
+			name:    "inject env name with injectEnvs",
+			config:  config{InjectEnvs: injectEnvs},
+			env:     map[string]string{envInjectEnvName: "GPUS"},
+			wantErr: true,
+		},
+		{
+			name:   "ignore namespaces with injectEnvs",
+			config: config{InjectEnvs: injectEnvs},
+			env:    map[string]string{envIgnoreNamespaces: "b"},
+			want:   config{InjectEnvs: injectEnvs, IgnoreNamespaces: []string{"b"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			err := applyEnvOverrides(&c, func(name string) string { return tt.env[name] })
+			if tt.wantErr {
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) || validationErr.Field != "injectEnvs" {
+					t.Errorf("applyEnvOverrides() error = %v, want a ValidationError of injectEnvs", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyEnvOverrides() error: %v", err)
+			}
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("applyEnvOverrides() = %+v, want %+v", c, tt.want)
+			}
+		})
+	}
+}
+
+// TestEnvOverridesNamespaceOverrides checks the inject env value variable takes precedence over the namespace overrides.
+func TestEnvOverridesNamespaceOverrides(t *testing.T) {
+	data := `
+injectEnvValue: "global"
+namespaceOverrides:
+  research:
+    injectEnvValue: "void"
+    gpuResourceNames: ["amd.com/gpu"]
+`
+	tests := []struct {
+		name      string
+		env       string
+		namespace string
+		want      string
+	}{
+		{name: "override without the variable", namespace: "research", want: "void"},
+		{name: "global without the variable", namespace: "default", want: "global"},
+		{name: "variable over the override", env: "env", namespace: "research", want: "env"},
+		{name: "variable over the global value", env: "env", namespace: "default", want: "env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envInjectEnvValue, tt.env)
+			c := newTestConfig(t, data)
+			if got := c.forNamespace(tt.namespace).InjectEnvValue; got != tt.want {
+				t.Errorf("injectEnvValue of namespace %s = %q, want %q", tt.namespace, got, tt.want)
+			}
+			// The other fields of the override still apply.
+			if got := c.forNamespace("research").GpuResourceNames; !reflect.DeepEqual(got, []string{"amd.com/gpu"}) {
+				t.Errorf("gpuResourceNames of namespace research = %v, want [amd.com/gpu]", got)
+			}
+		})
+	}
+}
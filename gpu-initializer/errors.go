@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ErrConfigMissing is returned when the config file, the configmap or its config key doesn't exist or is empty.
+var ErrConfigMissing = errors.New("config is missing")
+
+// ValidationError is returned for a config field with an invalid value.
+type ValidationError struct {
+	// The path of the field, e.g. "ignoreNamespaces[0]".
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config field %s: %s", e.Field, e.Message)
+}
+
+// invalidField returns the ValidationError of the field, formatting the message like fmt.Sprintf.
+func invalidField(field string, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// PatchError is returned when patching a pod failed, wrapping the API error.
+type PatchError struct {
+	Namespace string
+	Name      string
+	Err       error
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("patching pod %s/%s: %s", e.Namespace, e.Name, e.Err)
+}
+
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent reports whether the API server rejected the patch in a way a retry doesn't change,
+// e.g. as invalid or because the pod is gone.
+func (e *PatchError) Permanent() bool {
+	return apierrors.IsInvalid(e.Err) ||
+		apierrors.IsBadRequest(e.Err) ||
+		apierrors.IsNotFound(e.Err) ||
+		apierrors.IsGone(e.Err)
+}
+
+// throttledError is returned when the API server rejected the patch with 429 Too Many Requests.
+// The pod is requeued after the delay the server suggested, or after the queue backoff when that is longer,
+// counting against -max-retries.
+type throttledError struct {
+	delay time.Duration
+	err   error
+}
+
+func (e *throttledError) Error() string {
+	return e.err.Error()
+}
+
+func (e *throttledError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+)
+
+const (
+	// eventSendTries is how many times an event is sent before it is dropped, when the API server can't be reached.
+	eventSendTries     = 3
+	eventRetryInterval = time.Second
+)
+
+// eventRecorder records the events on the pods and sends them to the sink in the background, like the client-go
+// recorder, but keeps track of the events not sent yet so shutdown can wait for them, see flush.
+type eventRecorder struct {
+	record.EventRecorder
+	pending inflightTracker
+}
+
+func newEventRecorder(sink record.EventSink) *eventRecorder {
+	broadcaster := record.NewBroadcaster()
+	r := &eventRecorder{EventRecorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})}
+	correlator := record.NewEventCorrelator(clock.RealClock{})
+	broadcaster.StartEventWatcher(func(event *corev1.Event) {
+		defer r.pending.done()
+		sendEvent(sink, correlator, event)
+	})
+	return r
+}
+
+func (r *eventRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.track(object)
+	r.EventRecorder.Event(object, eventtype, reason, message)
+}
+
+func (r *eventRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.track(object)
+	r.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func (r *eventRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.track(object)
+	r.EventRecorder.PastEventf(object, timestamp, eventtype, reason, messageFmt, args...)
+}
+
+func (r *eventRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.track(object)
+	r.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+}
+
+// track counts the event as pending until it is sent. The recorder drops the events on objects it can't reference,
+// they never reach the sink.
+func (r *eventRecorder) track(object runtime.Object) {
+	if _, err := reference.GetReference(scheme.Scheme, object); err == nil {
+		r.pending.start()
+	}
+}
+
+// flush waits up to timeout for the recorded events to be sent, so the last ones are not lost on exit.
+func (r *eventRecorder) flush(timeout time.Duration) {
+	sent, dropped := r.pending.wait(timeout)
+	slog.Info("Flushed the pod events", "sent", sent, "dropped", dropped)
+}
+
+// sendEvent writes the event to the sink, updating the existing event when the correlator aggregated it. Like the
+// client-go recorder, it only retries when the API server could not be reached.
+func sendEvent(sink record.EventSink, correlator *record.EventCorrelator, event *corev1.Event) {
+	// The event is shared with the other watchers of the broadcaster.
+	eventCopy := *event
+	result, err := correlator.EventCorrelate(&eventCopy)
+	if err != nil {
+		slog.Error("Correlating the event failed", "reason", eventCopy.Reason, "error", err)
+	}
+	if result.Skip {
+		return
+	}
+	for tries := 1; ; tries++ {
+		var sent *corev1.Event
+		if result.Event.Count > 1 {
+			sent, err = sink.Patch(result.Event, result.Patch)
+		}
+		// The aggregated event may have been removed in the meantime.
+		if result.Event.Count <= 1 || apierrors.IsNotFound(err) {
+			result.Event.ResourceVersion = ""
+			sent, err = sink.Create(result.Event)
+		}
+		if err == nil {
+			correlator.UpdateState(sent)
+			return
+		}
+		if _, ok := err.(*apierrors.StatusError); ok || tries >= eventSendTries {
+			slog.Error("Sending the event failed", "reason", result.Event.Reason, "object", result.Event.InvolvedObject.Name, "namespace", result.Event.Namespace, "error", err)
+			return
+		}
+		time.Sleep(eventRetryInterval)
+	}
+}
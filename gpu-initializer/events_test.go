@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// testEventSink collects the events sent to it, slowly, so a flush that does not wait for them loses them.
+type testEventSink struct {
+	mu     sync.Mutex
+	events []string
+	err    error
+}
+
+func (s *testEventSink) Create(event *corev1.Event) (*corev1.Event, error) {
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.events = append(s.events, event.InvolvedObject.Name+" "+event.Reason)
+	return event, nil
+}
+
+func (s *testEventSink) Update(event *corev1.Event) (*corev1.Event, error) {
+	return s.Create(event)
+}
+
+func (s *testEventSink) Patch(event *corev1.Event, data []byte) (*corev1.Event, error) {
+	return s.Create(event)
+}
+
+func TestEventRecorderFlush(t *testing.T) {
+	tests := []struct {
+		name       string
+		pods       int
+		noSelfLink bool
+		err        error
+		wantEvents int
+	}{
+		{name: "no events", pods: 0},
+		{name: "all events sent", pods: 5, wantEvents: 5},
+		{name: "unreferenced pods are not waited for", pods: 2, noSelfLink: true},
+		{name: "rejected events don't block the flush", pods: 3, err: apierrors.NewForbidden(schema.GroupResource{Resource: "events"}, "", fmt.Errorf("denied"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &testEventSink{err: tt.err}
+			recorder := newEventRecorder(sink)
+			for i := 0; i < tt.pods; i++ {
+				pod := newTestPod(fmt.Sprintf("pod-%d", i))
+				pod.UID = types.UID(pod.Name)
+				if !tt.noSelfLink {
+					pod.SelfLink = "/api/v1/namespaces/default/pods/" + pod.Name
+				}
+				recordEvent(recorder, pod, "Injected", "Injected the inject env")
+			}
+
+			start := time.Now()
+			recorder.flush(5 * time.Second)
+			if elapsed := time.Since(start); elapsed > 4*time.Second {
+				t.Errorf("flush() took %v, want it to return once the events are handled", elapsed)
+			}
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			if len(sink.events) != tt.wantEvents {
+				t.Errorf("flush() sent %d events (%v), want %d", len(sink.events), sink.events, tt.wantEvents)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// healthzHandler responds 200 once synced reports true, and 503 before that.
+func healthzHandler(synced func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !synced() {
+			http.Error(w, "informer not synced", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
+
+// serveHealth serves the /healthz endpoint on addr.
+func serveHealth(addr string, synced func() bool) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthzHandler(synced))
+
+	slog.Info("Serving health checks", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fatal("Serving health checks", "addr", addr, "error", err)
+	}
+}
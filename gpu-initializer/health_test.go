@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		synced     bool
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "not synced",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "informer not synced",
+		},
+		{
+			name:       "synced",
+			synced:     true,
+			wantStatus: http.StatusOK,
+			wantBody:   "ok",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			healthzHandler(func() bool { return tt.synced }).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestHealthzHandlerSync checks the handler follows the informer once it syncs.
+func TestHealthzHandlerSync(t *testing.T) {
+	var synced atomic.Bool
+	srv := httptest.NewServer(healthzHandler(synced.Load))
+	defer srv.Close()
+
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("synced %v: status = %d, want %d", synced.Load(), resp.StatusCode, want)
+		}
+		synced.Store(true)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// newLeaderElector returns an elector that calls run while this replica holds the lock in namespace,
+// so only one replica initializes pods. Losing the lock before ctx is done exits the process,
+// the informer is then restarted cleanly with the replica.
+//
+// The lock is a ConfigMap, Lease locks need a newer client-go than the one still serving Initializers.
+func newLeaderElector(ctx context.Context, clientset kubernetes.Interface, namespace, name string, run func(ctx context.Context)) (*leaderelection.LeaderElector, error) {
+	id, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := resourcelock.New(resourcelock.ConfigMapsResourceLock, namespace, name, clientset.CoreV1(), resourcelock.ResourceLockConfig{Identity: id})
+	if err != nil {
+		return nil, err
+	}
+
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				slog.Info("Started leading", "identity", id, "lock", namespace+"/"+name)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					return
+				}
+				fatal("Lost the leader election", "identity", id, "lock", namespace+"/"+name)
+			},
+		},
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+)
+
+// klogFlags holds the klog flags. Only -v is exposed, the log destination is always stderr.
+var klogFlags = flag.NewFlagSet("klog", flag.ExitOnError)
+
+// registerLogFlags registers the -v verbosity flag, unless glog (used by client-go) already did.
+// Either way setupLogging applies its value to klog, so a single -v controls both.
+func registerLogFlags() {
+	klog.InitFlags(klogFlags)
+	if flag.Lookup("v") == nil {
+		v := klogFlags.Lookup("v")
+		flag.Var(v.Value, v.Name, v.Usage)
+	}
+}
+
+// setupLogging replaces the default logger according to the log format and the -v verbosity.
+// Debug messages are logged from -v=4 on, like the detailed logs of the Kubernetes components.
+func setupLogging(format string) error {
+	v := flag.Lookup("v").Value.String()
+	verbosity, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid log verbosity %q: %v", v, err)
+	}
+	if err := klogFlags.Set("v", v); err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(logr.ToSlogHandler(klog.Background())))
+	case "json":
+		l := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.Level(-verbosity)}))
+		slog.SetDefault(l)
+		klog.SetSlogLogger(l)
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+	return nil
+}
+
+// fatal logs the message at error level and exits after flushing the logs, like klog.Fatal.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+}
@@ -1,195 +1,1607 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"syscall"
 	"time"
 	"io/ioutil"
 
 	"github.com/ghodss/yaml"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+	"gomodules.xyz/jsonpatch/v2"
 
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
 )
 
 const (
 	defaultInitializerName = "gpu.initializer.kubernetes.io"
 	defaultConfigmap       = "gpu-initializer"
+	defaultConfigmapKey    = "config"
+	eventComponent         = "gpu-initializer"
+	defaultInjectEnvName   = "NVIDIA_VISIBLE_DEVICES"
+	defaultInjectEnvValue  = "none"
+	defaultGpuResourceName = "nvidia.com/gpu"
+	defaultSkipAnnotation  = "gpu.initializer.kubernetes.io/skip"
+	defaultMaskVolumeName  = "gpu-initializer-mask"
+	containersAnnotation   = "gpu.initializer.kubernetes.io/containers"
+	injectedAtAnnotation   = "gpu.initializer.kubernetes.io/injected-at"
+	injectedByAnnotation   = "gpu.initializer.kubernetes.io/injected-by"
+	skipReasonAnnotation   = "gpu.initializer.kubernetes.io/skip-reason"
+	mirrorPodAnnotation    = "kubernetes.io/config.mirror"
+	managedByLabel         = "app.kubernetes.io/managed-by"
+	defaultMetricsAddr     = ":8080"
+	defaultHealthAddr      = ":8081"
+	defaultShutdownTimeout = 10 * time.Second
+	defaultResyncPeriod    = 30 * time.Second
+	defaultAPITimeout      = 10 * time.Second
+	defaultLogFormat       = "text"
+	defaultPatchAttempts   = 4
+	defaultMaxRetries      = 5
+	defaultWorkers         = 1
+	defaultPatchQPS        = 5
+	defaultPatchBurst      = 10
+	defaultKubeAPIQPS      = 5
+	defaultKubeAPIBurst    = 10
+	defaultWebhookAddr     = ":8443"
+	defaultLargePatchBytes = 256 << 10
+	defaultOTLPEndpoint    = "localhost:4318"
+
+	defaultProtectedNamespaces = "kube-system,kube-public,kube-node-lease"
+
+	gpuContainersAnnotation = "gpu.initializer.kubernetes.io/gpu-containers"
+
+	defaultLeaderElectionID = "gpu-initializer-leader"
+
+	modeInitializer = "initializer"
+	modeWebhook     = "webhook"
+
+	patchTypeStrategic = "strategic"
+	patchTypeJSON      = "json"
+
+	onConfigErrorFatal    = "fatal"
+	onConfigErrorContinue = "continue"
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// configV1alpha1 is the current config schema, assumed when the config has no apiVersion.
+	configV1alpha1 = "v1alpha1"
 )
 
 var (
 	initializerName   string
 	configmap         string
+	configmaps        string
+	configmapKey      string
+	dryRun            bool
+	metricsAddr       string
+	healthAddr        string
+	kubeconfig        string
+	namespaceFile     string
+	namespace         string
+	shutdownTimeout   time.Duration
+	logFormat         string
+	patchAttempts     int
+	maxRetries        int
+	workers           int
+	auditLogFile      string
+	patchQPS          float64
+	patchBurst        int
+	kubeAPIQPS        float64
+	kubeAPIBurst      int
+	mode              string
+	webhookAddr       string
+	tlsCertFile       string
+	tlsKeyFile        string
+	configFile        string
+	patchType         string
+	resyncPeriod      time.Duration
+	resyncJitter      float64
+	apiTimeout        time.Duration
+	once              bool
+	watchNamespaces   string
+	namespaceMetrics  bool
+	largePatchBytes   int
+	printConfig       bool
+	validateOnly      bool
+	testPods          string
+	onConfigError     string
+	enableTracing     bool
+	otlpEndpoint      string
+	printVersion      bool
+
+	// Also check the initialized pods, see reconcilePod.
+	reconcileInitialized bool
+
+	protectedNamespaces string
+	// Parsed from -protected-namespaces, pods in these namespaces are never mutated whatever the config says.
+	protectedNamespaceList []string
+
+	enableLeaderElection    bool
+	leaderElectionID        string
+	leaderElectionNamespace string
 )
 
+// patchLimiter gates the pod patches, so a burst of new pods doesn't overload the API server.
+var patchLimiter = rate.NewLimiter(rate.Inf, 0)
+
 type config struct {
-	IgnoreNamespaces []string
+	// The version of the config schema, see configParsers.
+	APIVersion string
+
+	// Set to false to stop mutating pods, e.g. during an incident. Pending initializers are still removed.
+	Enabled *bool
+
+	// When set, only pods in these namespaces are injected, minus the ignored namespaces.
+	OnlyNamespaces          []string
+	IgnoreNamespaces        []string
+	IgnoreNamespaceSelector *metav1.LabelSelector
+	IgnoreNamespaceRegexes  []string
+
+	// When set, only pods whose labels match are injected.
+	PodSelector *metav1.LabelSelector
+
+	InjectEnvName    string
+	InjectEnvValue   string
+	GpuResourceNames []string
+
+	// When set, these envs are injected instead of InjectEnvName=InjectEnvValue, e.g. to set NVIDIA_DRIVER_CAPABILITIES too.
+	InjectEnvs []corev1.EnvVar
+
+	// Resource names matching one of these patterns are GPU resources too, e.g. "gpu.intel.com/*".
+	GpuResourcePatterns []string
+
+	// When set, only a container requesting at least this many of a GPU resource is a GPU container.
+	// Unset, any positive quantity is.
+	GpuThreshold *resource.Quantity
+
+	// Pods using one of these runtime classes or schedulers are GPU pods and are left untouched, whatever their resources.
+	GpuRuntimeClasses []string
+	GpuSchedulerNames []string
+
+	// Pods owned by a controller of one of these kinds are left untouched, e.g. "DaemonSet".
+	IgnoreOwnerKinds []string
+
+	// Pods whose app.kubernetes.io/managed-by label is one of these are left untouched, e.g. "gpu-operator".
+	IgnoreManagedBy []string
+
+	IncludeInitContainers bool
+	SkipAnnotation        string
+	PreserveExistingEnv   bool
+	IncludeContainers     []string
+	ExcludeContainers     []string
+
+	// Injected after the inject env, overriding envs of the same name.
+	ExtraEnv []corev1.EnvVar
+
+	// Appended to the envFrom of the injected containers, skipping sources they already list.
+	InjectEnvFrom []corev1.EnvFromSource
+
+	// Sets a zero limit of each GpuResourceNames resource on the injected containers.
+	InjectZeroGpuLimit bool
+
+	// When set, an emptyDir volume named MaskVolumeName is mounted at this path in the injected
+	// containers, hiding the device files a runtime may still expose there.
+	MaskDevicePath string
+	MaskVolumeName string
+
+	// Merged into the security context of the injected containers, keeping the fields they set.
+	InjectSecurityContext *corev1.SecurityContext
+
+	// The cpu and memory requests the injected containers get when they don't set them. Limits can't be defaulted.
+	InjectDefaultResources corev1.ResourceRequirements
+
+	// Merged into pods without any GPU container.
+	InjectTolerations  []corev1.Toleration
+	InjectNodeAffinity *corev1.NodeAffinity
+
+	// Prepended to the init containers of pods without any GPU container, e.g. to clean up GPU state.
+	InjectInitContainer *corev1.Container
+
+	// Stamps the injected pods with the injected-at and injected-by annotations.
+	AuditAnnotations bool
+
+	// Strips any change to spec.overhead from the patches, true by default.
+	PreserveOverhead bool
+
+	// Stamps the pods left untouched with the skip-reason annotation.
+	SkipReasonAnnotations bool
+
+	// Leaves the mirror pods of static pods untouched, true by default. The kubelet runs the static pod
+	// from its manifest, changes to the mirror pod don't reach it.
+	SkipMirrorPods bool
+
+	// Per namespace overrides of the settings above, keyed by namespace.
+	NamespaceOverrides map[string]NamespaceConfig
+
+	// Compiled from IgnoreNamespaceSelector, IgnoreNamespaceRegexes and PodSelector when the config is loaded.
+	ignoreNamespaceSelector labels.Selector
+	ignoreNamespaceRegexes  []*regexp.Regexp
+	podSelector             labels.Selector
+
+	// Set by forPod from the gpu-containers annotation.
+	gpuContainers []string
+}
+
+// NamespaceConfig overrides the global config for the pods in a namespace.
+// Unset fields fall back to the global config.
+type NamespaceConfig struct {
+	InjectEnvValue   string
+	GpuResourceNames []string
 }
 
 
 func main() {
 	flag.StringVar(&initializerName, "initializer-name", defaultInitializerName, "The initializer name")
 	flag.StringVar(&configmap, "configmap", defaultConfigmap, "The gpu initializer configuration configmap")
+	flag.StringVar(&configmaps, "configmaps", "", "Comma separated configmaps merged into the configuration in order, replaces -configmap")
+	flag.StringVar(&configmapKey, "configmap-key", defaultConfigmapKey, "The key of the configuration in the configmap")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the computed patches without applying them")
+	flag.StringVar(&metricsAddr, "metrics-addr", defaultMetricsAddr, "The address to serve Prometheus metrics on")
+	flag.StringVar(&healthAddr, "health-addr", defaultHealthAddr, "The address to serve the /healthz endpoint on")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig, only required when running out of cluster")
+	flag.StringVar(&namespace, "namespace", "", "The namespace of the configmap, takes precedence over -namespace-file and POD_NAMESPACE")
+	flag.StringVar(&namespaceFile, "namespace-file", serviceAccountNamespaceFile, "The file to read the namespace of the configmap from, POD_NAMESPACE is used when it can not be read")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "How long to wait for in-flight pods and their events on shutdown")
+	flag.StringVar(&logFormat, "log-format", defaultLogFormat, "The log format, text or json")
+	flag.IntVar(&patchAttempts, "patch-attempts", defaultPatchAttempts, "How many times to attempt a pod patch that fails with a transient error")
+	flag.IntVar(&maxRetries, "max-retries", defaultMaxRetries, "How many times to requeue a pod that failed to initialize before giving up")
+	flag.IntVar(&workers, "workers", defaultWorkers, "How many pods to initialize in parallel")
+	flag.StringVar(&auditLogFile, "audit-log", "", "Append a JSON line for each patched pod to this file, reopened on SIGHUP")
+	flag.StringVar(&mode, "mode", modeInitializer, "Run as an initializer or as a mutating admission webhook, initializer or webhook")
+	flag.StringVar(&webhookAddr, "webhook-addr", defaultWebhookAddr, "The address to serve the admission webhook on")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "The TLS certificate of the admission webhook")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "The TLS private key of the admission webhook")
+	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false, "Elect a leader, so only one replica initializes pods")
+	flag.StringVar(&leaderElectionID, "leader-election-id", defaultLeaderElectionID, "The name of the leader election lock")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "", "The namespace of the leader election lock, defaults to the namespace of the configmap")
+	flag.BoolVar(&once, "once", false, "Initialize the currently uninitialized pods once and exit, non-zero if any failed")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "", "Comma separated namespaces to watch pods in, all namespaces when empty")
+	flag.BoolVar(&namespaceMetrics, "namespace-metrics", true, "Label the injection metric with the pod namespace, disable on clusters with many namespaces")
+	flag.StringVar(&protectedNamespaces, "protected-namespaces", defaultProtectedNamespaces, "Comma separated namespaces whose pods are never mutated, regardless of the configuration")
+	flag.IntVar(&largePatchBytes, "large-patch-bytes", defaultLargePatchBytes, "Warn about pod patches larger than this many bytes")
+	flag.BoolVar(&printConfig, "print-config", false, "Log the effective configuration, defaults included, once it is loaded")
+	flag.BoolVar(&validateOnly, "validate-only", false, "Validate the -config-file, print OK or the error and exit without connecting to a cluster")
+	flag.StringVar(&testPods, "test-pods", "", "Print how the -config-file injects each pod YAML in this directory and exit without connecting to a cluster")
+	flag.StringVar(&onConfigError, "on-config-error", onConfigErrorFatal, "What to do when the configuration can not be loaded at startup, fatal or continue with the default configuration")
+	flag.BoolVar(&enableTracing, "enable-tracing", false, "Export OpenTelemetry traces of the pod processing to -otlp-endpoint")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", defaultOTLPEndpoint, "The host:port of the OTLP/HTTP trace collector")
+	flag.BoolVar(&printVersion, "version", false, "Print the version and build info and exit")
+	flag.BoolVar(&reconcileInitialized, "reconcile-initialized", false, "Report initialized pods that no longer match the injection policy, checked on each resync")
+	registerLogFlags()
+	flag.Float64Var(&patchQPS, "patch-qps", defaultPatchQPS, "The maximum pod patches per second")
+	flag.IntVar(&patchBurst, "patch-burst", defaultPatchBurst, "The maximum burst of pod patches")
+	flag.Float64Var(&kubeAPIQPS, "kube-api-qps", defaultKubeAPIQPS, "The maximum queries per second to the API server")
+	flag.IntVar(&kubeAPIBurst, "kube-api-burst", defaultKubeAPIBurst, "The maximum burst of queries to the API server")
+	flag.StringVar(&configFile, "config-file", "", "Read the configuration from this file instead of the configmap")
+	flag.StringVar(&patchType, "patch-type", patchTypeStrategic, "The type of the pod patches, strategic or json")
+	flag.DurationVar(&resyncPeriod, "resync-period", defaultResyncPeriod, "How often the pod informer resyncs")
+	flag.Float64Var(&resyncJitter, "resync-jitter", 0, "Randomize the resync period of each informer within this fraction of -resync-period, between 0 and 1")
+	flag.DurationVar(&apiTimeout, "api-timeout", defaultAPITimeout, "The timeout of each API server request made for a pod")
 	flag.Parse()
 
-	log.Println("Starting the Kubernetes initializer...")
-	log.Printf("Initializer name set to: %s", initializerName)
+	if printVersion {
+		fmt.Printf("gpu-initializer %s, commit %s, built %s\n", version, gitCommit, buildDate)
+		return
+	}
+	if err := setupLogging(logFormat); err != nil {
+		fatal("Setting up logging", "error", err)
+	}
+	protectedNamespaceList = splitList(protectedNamespaces)
+	if validateOnly {
+		os.Exit(validateConfigFile())
+	}
+	if testPods != "" {
+		os.Exit(testPodFiles(testPods))
+	}
+	if patchAttempts < 1 {
+		fatal("Invalid -patch-attempts, it must be at least 1", "patch-attempts", patchAttempts)
+	}
+	if maxRetries < 0 {
+		fatal("Invalid -max-retries, it must not be negative", "max-retries", maxRetries)
+	}
+	if workers < 1 {
+		fatal("Invalid -workers, it must be at least 1", "workers", workers)
+	}
+	if patchQPS <= 0 || patchBurst < 1 {
+		fatal("Invalid -patch-qps or -patch-burst, they must be positive", "patch-qps", patchQPS, "patch-burst", patchBurst)
+	}
+	patchLimiter = rate.NewLimiter(rate.Limit(patchQPS), patchBurst)
+	if patchType != patchTypeStrategic && patchType != patchTypeJSON {
+		fatal("Invalid -patch-type, it must be strategic or json", "patch-type", patchType)
+	}
+	if apiTimeout <= 0 {
+		fatal("Invalid -api-timeout, it must be positive", "api-timeout", apiTimeout)
+	}
+	if resyncPeriod <= 0 {
+		fatal("Invalid -resync-period, it must be positive", "resync-period", resyncPeriod)
+	}
+	if resyncJitter < 0 || resyncJitter >= 1 {
+		fatal("Invalid -resync-jitter, it must be at least 0 and less than 1", "resync-jitter", resyncJitter)
+	}
+	if onConfigError != onConfigErrorFatal && onConfigError != onConfigErrorContinue {
+		fatal("Invalid -on-config-error, it must be fatal or continue", "on-config-error", onConfigError)
+	}
+	if mode != modeInitializer && mode != modeWebhook {
+		fatal("Invalid -mode, it must be initializer or webhook", "mode", mode)
+	}
+	if mode == modeWebhook && (tlsCertFile == "" || tlsKeyFile == "") {
+		fatal("The webhook requires -tls-cert-file and -tls-key-file")
+	}
+	if mode == modeWebhook && once {
+		fatal("-once is only supported in initializer mode")
+	}
+
+	slog.Info("Starting the Kubernetes initializer...", "mode", mode, "version", version, "commit", gitCommit, "build-date", buildDate)
+	slog.Info("Initializer name set", "initializer", initializerName)
+	if dryRun {
+		slog.Info("Dry run enabled, pods will not be patched")
+	}
 
-	clusterConfig, err := rest.InClusterConfig()
-	if err != nil {
-		log.Fatal(err.Error())
+	go serveMetrics(metricsAddr)
+
+	// Exiting with a non-zero code skips the deferred shutdown steps, so the exit is deferred first to run last.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			klog.FlushAndExit(klog.ExitFlushTimeout, exitCode)
+		}
+	}()
+
+	if enableTracing {
+		shutdownTracing, err := setupTracing(context.Background(), otlpEndpoint)
+		if err != nil {
+			fatal("Setting up tracing", "error", err)
+		}
+		defer shutdownTracing(context.Background())
+		slog.Info("Tracing enabled", "otlp-endpoint", otlpEndpoint)
 	}
 
-	clientset, err := kubernetes.NewForConfig(clusterConfig)
+	if auditLogFile != "" {
+		l, err := newAuditLogger(auditLogFile)
+		if err != nil {
+			fatal("Opening the audit log", "audit-log", auditLogFile, "error", err)
+		}
+		audit = l
+		defer audit.close()
+	}
+
+	clusterConfig, err := buildConfig(kubeconfig)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Building the cluster config", "error", err)
 	}
+	clusterConfig.QPS = float32(kubeAPIQPS)
+	clusterConfig.Burst = kubeAPIBurst
 
-	bs, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	// Watches stream for longer than -api-timeout, so the informers get their own clientset without
+	// the timeout.
+	watchClientset, err := kubernetes.NewForConfig(clusterConfig)
+	if err != nil {
+		fatal("Creating the clientset", "error", err)
+	}
+	requestConfig := rest.CopyConfig(clusterConfig)
+	requestConfig.Timeout = apiTimeout
+	clientset, err := kubernetes.NewForConfig(requestConfig)
 	if err != nil {
-		log.Fatal("getting namespace from pod service account data: %s", err)
+		fatal("Creating the clientset", "error", err)
 	}
-	namespace := string(bs)
 
-	// Load the GPU Initializer configuration from a Kubernetes ConfigMap.
-	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(configmap, metav1.GetOptions{})
+	namespace, err = resolveNamespace(namespace, namespaceFile, os.Getenv)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Getting namespace from -namespace, the namespace file or POD_NAMESPACE", "namespace-file", namespaceFile, "error", err)
 	}
 
-	c, err := configmapToConfig(cm)
+	// The root context is cancelled on the shutdown signal, stopping the informers. In-flight pods use
+	// podCtx instead, which is only cancelled once -shutdown-timeout passed, so they can still be patched.
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := ctx.Done()
+	podCtx, cancelPods := context.WithCancel(context.Background())
+
+	store := &configStore{}
+	c, err := loadConfig(ctx, clientset)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Watch uninitialized Pods in all namespaces.
-	restClient := clientset.Core().RESTClient()
-	watchlist := cache.NewListWatchFromClient(restClient, "pods", corev1.NamespaceAll, fields.Everything())
-
-	// Wrap the returned watchlist to workaround the inability to include
-	// the `IncludeUninitialized` list option when setting up watch clients.
-	includeUninitializedWatchlist := &cache.ListWatch{
-		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			options.IncludeUninitialized = true
-			return watchlist.List(options)
-		},
-		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			options.IncludeUninitialized = true
-			return watchlist.Watch(options)
-		},
-	}
-
-	resyncPeriod := 30 * time.Second
-
-	_, controller := cache.NewInformer(includeUninitializedWatchlist, &corev1.Pod{}, resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				err := initializePod(obj.(*corev1.Pod), c, clientset)
-				if err != nil {
-					log.Println(err)
-				}
-			},
-		},
-	)
+		configErrors.Inc()
+		if onConfigError == onConfigErrorFatal {
+			fatal("Loading config", "error", err)
+		}
+		// Fail open: keep initializing pods with the default config until a valid one is loaded.
+		slog.Error("Loading config failed, continuing with the default config", "error", err)
+		c, err = parseConfig([]byte("{}"))
+		if err != nil {
+			fatal("Loading the default config", "error", err)
+		}
+	}
+	store.Store(c)
+	if printConfig {
+		bs, err := configYAML(c)
+		if err != nil {
+			fatal("Printing config", "error", err)
+		}
+		slog.Info("Effective config", "config", string(bs))
+	}
+	if configFile == "" {
+		for _, name := range configmapNames() {
+			go watchConfigMap(ctx, clientset, watchClientset, namespace, name, store)
+		}
+	}
+
+	inflight := &inflightTracker{}
+
+	if mode == modeWebhook {
+		// There is no informer to wait for, the webhook is healthy as soon as it is serving.
+		go serveHealth(healthAddr, func() bool { return true })
+		go serveWebhook(webhookAddr, tlsCertFile, tlsKeyFile, store, clientset, inflight)
+	} else {
+		// Record events on the pods, so `kubectl describe pod` shows what the initializer did.
+		recorder := newEventRecorder(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+		defer recorder.flush(shutdownTimeout)
+
+		if once {
+			processed, failed, err := runOnce(ctx, clientset, store.Load(), recorder)
+			if err != nil {
+				fatal("Listing uninitialized pods", "error", err)
+			}
+			slog.Info("Processed the uninitialized pods once", "processed", processed, "failed", failed)
+			if failed > 0 {
+				exitCode = 1
+			}
+			return
+		}
 
-	stop := make(chan struct{})
-	go controller.Run(stop)
+		slog.Info("Resync period set", "resync-period", resyncPeriod, "resync-jitter", resyncJitter)
+		controller := newPodController(podCtx, clientset, watchClientset, watchNamespaceList(), store, recorder, inflight)
+		if enableLeaderElection {
+			if leaderElectionNamespace == "" {
+				leaderElectionNamespace = namespace
+			}
+			elector, err := newLeaderElector(ctx, clientset, leaderElectionNamespace, leaderElectionID, func(ctx context.Context) {
+				controller.Run(ctx.Done())
+			})
+			if err != nil {
+				fatal("Setting up leader election", "error", err)
+			}
+			// Standby replicas run no informer, they are healthy while waiting to lead.
+			go serveHealth(healthAddr, func() bool {
+				return !elector.IsLeader() || controller.HasSynced()
+			})
+			go elector.Run(ctx)
+		} else {
+			go serveHealth(healthAddr, controller.HasSynced)
+			go controller.Run(stop)
+		}
+	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		reloadConfig(ctx, clientset, store)
+		audit.reopen()
+	}
+
+	slog.Info("Shutdown signal received, exiting...")
+	cancel()
 
-	log.Println("Shutdown signal received, exiting...")
-	close(stop)
+	drained, abandoned := inflight.wait(shutdownTimeout)
+	cancelPods()
+	slog.Info("Drained in-flight pods", "drained", drained, "abandoned", abandoned)
 }
 
-func initializePod(pod *corev1.Pod, c *config, clientset *kubernetes.Clientset) error {
+// watchNamespaceList returns the namespaces given by -watch-namespaces, or all namespaces when it is empty.
+func watchNamespaceList() []string {
+	namespaces := splitList(watchNamespaces)
+	if len(namespaces) == 0 {
+		return []string{corev1.NamespaceAll}
+	}
+	return namespaces
+}
+
+// splitList splits a comma separated flag value, dropping blank items.
+func splitList(s string) []string {
+	items := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			items = append(items, v)
+		}
+	}
+	return items
+}
+
+// resolveNamespace returns the namespace of the configmap: the -namespace flag when it is set, otherwise the
+// namespace read from the namespace file. Outside of a pod there is no service account, so it falls back to
+// POD_NAMESPACE.
+func resolveNamespace(flagNamespace, namespaceFile string, getenv func(string) string) (string, error) {
+	if flagNamespace != "" {
+		return flagNamespace, nil
+	}
+	bs, err := ioutil.ReadFile(namespaceFile)
+	if err == nil {
+		return strings.TrimSpace(string(bs)), nil
+	}
+	if ns := getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	return "", err
+}
+
+// buildConfig returns the config for the cluster in kubeconfig, or the in-cluster config when kubeconfig is empty.
+func buildConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
+
+func initializePod(ctx context.Context, pod *corev1.Pod, c *config, clientset kubernetes.Interface, recorder record.EventRecorder) (err error) {
+	if reconcileInitialized && (pod.ObjectMeta.GetInitializers() == nil || len(pod.ObjectMeta.GetInitializers().Pending) == 0) {
+		return reconcilePod(ctx, pod, c, clientset, recorder)
+	}
 	if pod.ObjectMeta.GetInitializers() != nil {
 		pendingInitializers := pod.ObjectMeta.GetInitializers().Pending
+		// An Initializers struct with nothing pending has nothing left for us to do.
+		if len(pendingInitializers) == 0 {
+			return nil
+		}
 
 		if initializerName == pendingInitializers[0].Name {
-			log.Printf("Initializing pod: %s", pod.Name)
+			slog.Info("Initializing pod", "pod", pod.Name, "namespace", pod.Namespace)
+			podsProcessed.Inc()
+			start := time.Now()
+			ctx, span := startPodSpan(ctx, "initializePod", pod)
+			defer func() { endSpan(span, err) }()
 
 			initializedPod := pod.DeepCopyObject().(*corev1.Pod)
 
 			// Remove self from the list of pending Initializers while preserving ordering.
-			if len(pendingInitializers) == 1 {
+			// A fresh slice keeps the original pod, shared with the informer cache, unchanged.
+			pending, removed := removeInitializer(pendingInitializers, initializerName)
+			if removed > 1 {
+				slog.Warn("Pod lists the initializer as pending more than once, removing all of them", "pod", pod.Name, "namespace", pod.Namespace, "count", removed)
+			}
+			if len(pending) == 0 {
 				initializedPod.ObjectMeta.Initializers = nil
 			} else {
-				initializedPod.ObjectMeta.Initializers.Pending = append(pendingInitializers[:0], pendingInitializers[1:]...)
+				initializedPod.ObjectMeta.Initializers.Pending = pending
 			}
 
-			// If the Pod is in ignoring namespace, do nothing
-			for _, v := range c.IgnoreNamespaces {
-				if v == initializedPod.ObjectMeta.Namespace {
-					log.Printf("Pod: %s is ignored", initializedPod.Name)
-					return applyNewPod(pod, initializedPod, clientset)
+			// If the Pod is being deleted, only remove self so the deletion isn't blocked.
+			if pod.ObjectMeta.DeletionTimestamp != nil {
+				slog.Debug("Pod is being deleted, not injecting", "pod", pod.Name, "namespace", pod.Namespace, "action", "deleting")
+				if err := applyNewPod(ctx, pod, initializedPod, c, clientset, podResource); err != nil {
+					return err
 				}
+				if !dryRun {
+					observeInitialized(pod, start)
+				}
+				return nil
 			}
 
-			// Modify the Pod spec to include the env NVIDIA_VISIBLE_DEVICES.
+			// Modify the Pod spec to include the inject env (NVIDIA_VISIBLE_DEVICES by default).
 			// Then patch the original pod.
-			inject_env := corev1.EnvVar{Name:"NVIDIA_VISIBLE_DEVICES", Value:"none"}
-			for i, v := range initializedPod.Spec.Containers {
-				// Delete original NVIDIA_VISIBLE_DEVICES parameter.
-				newEnv := []corev1.EnvVar{}
-				for _, vv := range v.Env {
-					if vv.Name != "NVIDIA_VISIBLE_DEVICES" {
-						newEnv = append(newEnv, vv)
-					}
-				}
-				// If not specified gpu resources, inject env.
-				gpu_limits, ok := v.Resources.Limits["nvidia.com/gpu"]
-				if !ok || (ok && gpu_limits.IsZero()) {
-					initializedPod.Spec.Containers[i].Env = append(newEnv, inject_env)
-				}
+			result, err := injectPod(ctx, initializedPod, c, clientset)
+			if err != nil {
+				return err
+			}
+			if err := applyNewPod(ctx, pod, initializedPod, c, clientset, podResource); err != nil {
+				return err
+			}
+			if !dryRun {
+				observeInitialized(pod, start)
+				result.count(pod)
+			}
+			if result.reason != "" {
+				recordEvent(recorder, pod, result.reason, result.message)
+			}
+			result.log(pod, "Initialized pod")
+			return nil
+		}
+
+		// Not our turn yet, report our position to help debug the ordering in the initializer configuration.
+		for i, v := range pendingInitializers {
+			if v.Name == initializerName {
+				slog.Debug("Pod is pending on other initializers first", "pod", pod.Name, "namespace", pod.Namespace, "position", i, "first", pendingInitializers[0].Name)
+				break
 			}
-			return applyNewPod(pod, initializedPod, clientset)
 		}
 	}
 	return nil
 }
 
+// isPendingOn reports whether the initializer of the name is the first pending initializer of the pod,
+// that is whether it is its turn to initialize the pod.
+func isPendingOn(pod *corev1.Pod, name string) bool {
+	initializers := pod.ObjectMeta.GetInitializers()
+	return initializers != nil && len(initializers.Pending) > 0 && initializers.Pending[0].Name == name
+}
+
+// removeInitializer returns a fresh copy of the pending initializers without the ones of the name, and how
+// many it removed. A malformed initializer configuration may list the name more than once, the duplicates are
+// removed too, otherwise the pod would be injected again when it reaches them.
+func removeInitializer(pending []metav1.Initializer, name string) ([]metav1.Initializer, int) {
+	kept := []metav1.Initializer{}
+	for _, v := range pending {
+		if v.Name != name {
+			kept = append(kept, v)
+		}
+	}
+	return kept, len(pending) - len(kept)
+}
+
+// injectResult describes what the injection policy did with a pod.
+type injectResult struct {
+	// The reason and message of the event to record, reason is empty when there is nothing to report.
+	reason  string
+	message string
+
+	ignored    bool
+	gpuPod     bool
+	containers []string
+	// Whether the pod spec was changed, as opposed to already matching the policy.
+	injected bool
+}
+
+// count updates the metrics of the decision. It is called once the pod was patched, and not in dry run mode,
+// so a pod whose patch failed and is retried is counted once.
+func (r injectResult) count(pod *corev1.Pod) {
+	switch {
+	case r.ignored:
+		podsIgnored.Inc()
+	case r.injected:
+		driftFixed.Inc()
+		countInjection(pod.Namespace)
+	default:
+		alreadyCompliant.Inc()
+	}
+}
+
+// log emits the one line summary of the decision taken for the pod.
+func (r injectResult) log(pod *corev1.Pod, msg string) {
+	slog.Info(msg, "pod", pod.Name, "namespace", pod.Namespace, "injected", len(r.containers) > 0, "containers", r.containers, "gpu", r.gpuPod, "ignored", r.ignored)
+}
+
+// injectPod applies the injection policy to the pod in place. It is shared by the initializer and the webhook.
+func injectPod(ctx context.Context, pod *corev1.Pod, c *config, clientset kubernetes.Interface) (injectResult, error) {
+	c = c.forNamespace(pod.Namespace).forPod(pod)
+	result := injectResult{gpuPod: isGpuPod(pod, c)}
+
+	s, err := skipReason(ctx, pod, c, clientset)
+	if err != nil {
+		return result, err
+	}
+	if s != nil {
+		slog.Info("Pod is ignored", "pod", pod.Name, "namespace", pod.Namespace, "action", "ignored", "reason", s.message)
+		result.ignored = true
+		result.gpuPod = result.gpuPod || s.gpuPod
+		result.reason, result.message = "Skipped", s.message
+		// A disabled policy and the protected namespaces mean no mutation at all, not even the annotation.
+		// Mirror pods only reflect the static pods, there is no point annotating them either.
+		if c.SkipReasonAnnotations && s.code != skipDisabled && s.code != skipProtectedNamespace && s.code != skipMirrorPod {
+			annotateSkipped(pod, s.code)
+		}
+		return result, nil
+	}
+
+	mutatedPod, err := mutatePodSpec(pod, c)
+	if err != nil {
+		return result, err
+	}
+	result.containers = changedContainers(pod, mutatedPod)
+	if apiequality.Semantic.DeepEqual(pod.Spec, mutatedPod.Spec) {
+		if c.SkipReasonAnnotations && result.gpuPod && len(result.containers) == 0 {
+			annotateSkipped(pod, skipGpuPod)
+		}
+		return result, nil
+	}
+	result.injected = true
+	pod.Spec = mutatedPod.Spec
+	if c.AuditAnnotations {
+		annotateInjected(pod)
+	}
+	result.reason, result.message = "Injected", fmt.Sprintf("Injected %s", formatEnvs(c.injectEnvs()))
+	return result, nil
+}
+
+// The codes of the skip-reason annotation.
+const (
+	skipDisabled           = "disabled"
+	skipNoContainers       = "no-containers"
+	skipMirrorPod          = "mirror-pod"
+	skipProtectedNamespace = "protected-namespace"
+	skipAnnotated          = "skip-annotation"
+	skipGpuRuntimeClass    = "gpu-runtime-class"
+	skipGpuScheduler       = "gpu-scheduler"
+	skipIgnoredOwnerKind   = "ignored-owner-kind"
+	skipIgnoredManagedBy   = "ignored-managed-by"
+	skipIgnoredNamespace   = "ignored-namespace"
+	skipPodSelector        = "pod-selector"
+	skipGpuPod             = "gpu-pod"
+)
+
+// skip describes why the policy leaves a pod untouched.
+type skip struct {
+	// The short reason recorded in the skip-reason annotation.
+	code    string
+	message string
+	// Whether the pod is left untouched for being a GPU pod.
+	gpuPod bool
+}
+
+// skipReason returns why the policy leaves the pod untouched, or nil when it applies to the pod.
+// c must be the config for the pod.
+func skipReason(ctx context.Context, pod *corev1.Pod, c *config, clientset kubernetes.Interface) (*skip, error) {
+	// If injection is disabled, do nothing
+	if c.Enabled != nil && !*c.Enabled {
+		return &skip{code: skipDisabled, message: "Injection is disabled"}, nil
+	}
+
+	// If the Pod has no containers at all, there is nothing to inject, only the pending initializer is removed
+	if len(pod.Spec.Containers) == 0 && len(pod.Spec.InitContainers) == 0 {
+		return &skip{code: skipNoContainers, message: "Pod has no containers"}, nil
+	}
+
+	// If the Pod is the mirror pod of a static pod, changing it doesn't change what the kubelet runs
+	if _, ok := pod.ObjectMeta.Annotations[mirrorPodAnnotation]; ok && c.SkipMirrorPods {
+		return &skip{code: skipMirrorPod, message: "Pod is a mirror pod"}, nil
+	}
+
+	// If the Pod is in a protected namespace, never touch it, whatever the config says
+	if containsString(protectedNamespaceList, pod.Namespace) {
+		return &skip{code: skipProtectedNamespace, message: fmt.Sprintf("Namespace %s is protected", pod.Namespace)}, nil
+	}
+
+	// If the Pod opted out with the skip annotation, do nothing
+	if pod.ObjectMeta.Annotations[c.SkipAnnotation] == "true" {
+		return &skip{code: skipAnnotated, message: fmt.Sprintf("Skipped by annotation %s", c.SkipAnnotation)}, nil
+	}
+
+	// If the Pod uses a GPU runtime class, do nothing
+	if rc := pod.Spec.RuntimeClassName; rc != nil && containsString(c.GpuRuntimeClasses, *rc) {
+		return &skip{code: skipGpuRuntimeClass, message: fmt.Sprintf("Runtime class %s is a GPU runtime class", *rc), gpuPod: true}, nil
+	}
+
+	// If the Pod is scheduled by a GPU scheduler, do nothing
+	if containsString(c.GpuSchedulerNames, pod.Spec.SchedulerName) {
+		return &skip{code: skipGpuScheduler, message: fmt.Sprintf("Scheduler %s is a GPU scheduler", pod.Spec.SchedulerName), gpuPod: true}, nil
+	}
+
+	// If the Pod is owned by an ignored kind, do nothing
+	if kind, ok := ignoredOwnerKind(pod, c); ok {
+		return &skip{code: skipIgnoredOwnerKind, message: fmt.Sprintf("Owner kind %s is ignored", kind)}, nil
+	}
+
+	// If the Pod is managed by an ignored component, do nothing
+	if managedBy, ok := pod.ObjectMeta.Labels[managedByLabel]; ok && containsString(c.IgnoreManagedBy, managedBy) {
+		return &skip{code: skipIgnoredManagedBy, message: fmt.Sprintf("Managed by %s, which is ignored", managedBy)}, nil
+	}
+
+	// If the Pod is in ignoring namespace, do nothing
+	ignored, err := isIgnoredNamespace(ctx, pod.ObjectMeta.Namespace, c, clientset)
+	if err != nil {
+		return nil, err
+	}
+	if ignored {
+		return &skip{code: skipIgnoredNamespace, message: fmt.Sprintf("Namespace %s is ignored", pod.Namespace)}, nil
+	}
+
+	// If the Pod doesn't match the pod selector, do nothing
+	if c.podSelector != nil && !c.podSelector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+		return &skip{code: skipPodSelector, message: "Pod labels do not match the pod selector"}, nil
+	}
+	return nil, nil
+}
+
+// annotateInjected records on the pod when and by which initializer it was injected.
+func annotateInjected(pod *corev1.Pod) {
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = map[string]string{}
+	}
+	pod.ObjectMeta.Annotations[injectedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	pod.ObjectMeta.Annotations[injectedByAnnotation] = initializerName
+}
+
+// annotateSkipped records on the pod why the policy left it untouched.
+func annotateSkipped(pod *corev1.Pod, code string) {
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = map[string]string{}
+	}
+	pod.ObjectMeta.Annotations[skipReasonAnnotation] = code
+}
+
+// ignoredOwnerKind returns the kind of the first pod owner listed in IgnoreOwnerKinds.
+func ignoredOwnerKind(pod *corev1.Pod, c *config) (string, bool) {
+	for _, ref := range pod.ObjectMeta.OwnerReferences {
+		if containsString(c.IgnoreOwnerKinds, ref.Kind) {
+			return ref.Kind, true
+		}
+	}
+	return "", false
+}
+
+// changedContainers returns the names of the containers and init containers that differ between the pods.
+// The containers are matched by name, as a mutator may add some, e.g. InjectInitContainer. A container
+// only in newPod is changed too.
+func changedContainers(oldPod *corev1.Pod, newPod *corev1.Pod) []string {
+	names := changedContainersOf(oldPod.Spec.InitContainers, newPod.Spec.InitContainers)
+	return append(names, changedContainersOf(oldPod.Spec.Containers, newPod.Spec.Containers)...)
+}
+
+func changedContainersOf(oldContainers, newContainers []corev1.Container) []string {
+	names := []string{}
+	for _, n := range newContainers {
+		changed := true
+		for _, o := range oldContainers {
+			if o.Name == n.Name {
+				changed = !apiequality.Semantic.DeepEqual(o, n)
+				break
+			}
+		}
+		if changed {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+// recordEvent records a normal event on the pod. Nothing is recorded in dry run mode, since nothing was applied.
+func recordEvent(recorder record.EventRecorder, pod *corev1.Pod, reason, message string) {
+	if dryRun {
+		return
+	}
+	recorder.Event(pod, corev1.EventTypeNormal, reason, message)
+}
+
+// mutatePodSpec returns a copy of the pod with the mutators applied, injecting the inject env into the containers
+// selected by the config. It makes no API calls, so the injection decision can be tested on its own.
+// The config must be the one for the pod, see forPod.
+func mutatePodSpec(pod *corev1.Pod, c *config) (*corev1.Pod, error) {
+	return applyMutators(pod, c, mutators)
+}
+
+// injectEnv strips the inject envs and the extra env from the containers and re-injects them into those not requesting a GPU.
+// With InjectZeroGpuLimit those containers also get a zero GPU limit, with InjectSecurityContext its fields they don't set,
+// and the InjectDefaultResources requests they don't set.
+func injectEnv(containers []corev1.Container, c *config) {
+	injectEnvs := c.injectEnvs()
+	for i, v := range containers {
+		// If specified gpu resources or not targeted, leave the container alone.
+		if requestsGpu(v, c) || !c.targetsContainer(v.Name) {
+			continue
+		}
+		env := v.Env
+		for _, e := range injectEnvs {
+			// Leave a value the user set deliberately alone.
+			if c.PreserveExistingEnv && hasEnv(v, e.Name) {
+				slog.Info("Container already sets the inject env, preserving it", "container", v.Name, "env", e.Name)
+				continue
+			}
+			env = setEnv(env, e)
+		}
+		for _, e := range c.ExtraEnv {
+			env = setEnv(env, e)
+		}
+		containers[i].Env = env
+		containers[i].EnvFrom = mergeEnvFrom(containers[i].EnvFrom, c.InjectEnvFrom)
+		if c.InjectZeroGpuLimit {
+			setZeroGpuLimits(&containers[i], c)
+		}
+		if c.MaskDevicePath != "" {
+			addMaskVolumeMount(&containers[i], c)
+		}
+		if c.InjectSecurityContext != nil {
+			containers[i].SecurityContext = mergeSecurityContext(containers[i].SecurityContext, c.InjectSecurityContext)
+		}
+		setDefaultResources(&containers[i], c)
+	}
+}
+
+// addMaskVolumeMount mounts the mask volume at MaskDevicePath, unless the container already mounts something there.
+func addMaskVolumeMount(container *corev1.Container, c *config) {
+	for _, m := range container.VolumeMounts {
+		if m.MountPath == c.MaskDevicePath {
+			return
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: c.MaskVolumeName, MountPath: c.MaskDevicePath})
+}
+
+// addMaskVolume adds the emptyDir mask volume to the pod when one of its containers mounts it.
+func addMaskVolume(pod *corev1.Pod, c *config) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == c.MaskVolumeName {
+			return
+		}
+	}
+	if mountsVolume(pod.Spec.InitContainers, c.MaskVolumeName) || mountsVolume(pod.Spec.Containers, c.MaskVolumeName) {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         c.MaskVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+}
+
+func mountsVolume(containers []corev1.Container, name string) bool {
+	for _, container := range containers {
+		for _, m := range container.VolumeMounts {
+			if m.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setZeroGpuLimits sets a zero limit of each GPU resource name on the container.
+// A zero limit doesn't make the container a GPU container, see requestsGpu.
+func setZeroGpuLimits(container *corev1.Container, c *config) {
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = corev1.ResourceList{}
+	}
+	for _, name := range c.GpuResourceNames {
+		// With a GpuThreshold the container may ask for fewer GPUs than the threshold, leave those alone.
+		if _, ok := container.Resources.Requests[corev1.ResourceName(name)]; ok {
+			continue
+		}
+		if _, ok := container.Resources.Limits[corev1.ResourceName(name)]; ok {
+			continue
+		}
+		container.Resources.Limits[corev1.ResourceName(name)] = resource.MustParse("0")
+	}
+}
+
+// injectEnvs returns the envs injected into the non-GPU containers, InjectEnvs when set, otherwise InjectEnvName=InjectEnvValue.
+func (c *config) injectEnvs() []corev1.EnvVar {
+	if len(c.InjectEnvs) > 0 {
+		return c.InjectEnvs
+	}
+	return []corev1.EnvVar{{Name: c.InjectEnvName, Value: c.InjectEnvValue}}
+}
+
+// formatEnvs returns the envs as a comma separated list of name=value, for events and logs.
+func formatEnvs(envs []corev1.EnvVar) string {
+	s := []string{}
+	for _, e := range envs {
+		s = append(s, e.Name+"="+e.Value)
+	}
+	return strings.Join(s, ",")
+}
+
+// setDefaultResources sets the InjectDefaultResources requests the container doesn't set. A resource the
+// container has a limit for is skipped: the API server defaults its request to the limit. No limit is
+// ever defaulted, a default limit could get the container OOM killed or throttled.
+func setDefaultResources(container *corev1.Container, c *config) {
+	for name, q := range c.InjectDefaultResources.Requests {
+		if _, ok := container.Resources.Requests[name]; ok {
+			continue
+		}
+		if _, ok := container.Resources.Limits[name]; ok {
+			continue
+		}
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		container.Resources.Requests[name] = q.DeepCopy()
+	}
+}
+
+// mergeEnvFrom appends the sources not already listed.
+func mergeEnvFrom(existing, sources []corev1.EnvFromSource) []corev1.EnvFromSource {
+	merged := existing
+	for _, s := range sources {
+		found := false
+		for _, e := range merged {
+			if apiequality.Semantic.DeepEqual(e, s) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, *s.DeepCopy())
+		}
+	}
+	return merged
+}
+
+// setEnv deletes the original env parameter of the same name, then appends the env.
+func setEnv(env []corev1.EnvVar, e corev1.EnvVar) []corev1.EnvVar {
+	newEnv := []corev1.EnvVar{}
+	for _, v := range env {
+		if v.Name != e.Name {
+			newEnv = append(newEnv, v)
+		}
+	}
+	return append(newEnv, e)
+}
+
+// forPod returns the config for the pod. A comma separated list of container names in the containers
+// annotation replaces IncludeContainers and ExcludeContainers. The containers listed in the gpu-containers
+// annotation are GPU containers whatever their resources, e.g. when the GPUs are mounted with a hostPath.
+// An annotation without any name is ignored.
+func (c *config) forPod(pod *corev1.Pod) *config {
+	nc := *c
+	if names, ok := annotationNames(pod, containersAnnotation); ok {
+		nc.IncludeContainers = names
+		nc.ExcludeContainers = nil
+	}
+	if names, ok := annotationNames(pod, gpuContainersAnnotation); ok {
+		nc.gpuContainers = names
+	}
+	return &nc
+}
+
+// annotationNames returns the comma separated container names of the pod annotation, if it has any.
+func annotationNames(pod *corev1.Pod, annotation string) ([]string, bool) {
+	value, ok := pod.ObjectMeta.Annotations[annotation]
+	if !ok {
+		return nil, false
+	}
+	names := splitList(value)
+	if len(names) == 0 {
+		slog.Warn("Ignoring annotation without container names", "pod", pod.Name, "namespace", pod.Namespace, "annotation", annotation)
+		return nil, false
+	}
+	return names, true
+}
+
+// targetsContainer reports whether the container is selected for injection by name.
+// A non-empty IncludeContainers selects only the listed containers, ExcludeContainers then filters within it.
+func (c *config) targetsContainer(name string) bool {
+	if len(c.IncludeContainers) > 0 && !containsString(c.IncludeContainers, name) {
+		return false
+	}
+	return !containsString(c.ExcludeContainers, name)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hasContainer reports whether one of the containers has the name.
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, v := range containers {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEnv reports whether the container defines the env name.
+func hasEnv(container corev1.Container, name string) bool {
+	for _, v := range container.Env {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isGpuPod reports whether any container or init container of the pod requests a GPU.
+func isGpuPod(pod *corev1.Pod, c *config) bool {
+	for _, v := range pod.Spec.Containers {
+		if requestsGpu(v, c) {
+			return true
+		}
+	}
+	for _, v := range pod.Spec.InitContainers {
+		if requestsGpu(v, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestsGpu reports whether the container has a non-zero limit or request for any GPU resource of the config.
+// Requests are checked too, since a malformed spec may set them without limits.
+// Containers listed in the gpu-containers annotation always count as requesting a GPU.
+func requestsGpu(container corev1.Container, c *config) bool {
+	if containsString(c.gpuContainers, container.Name) {
+		return true
+	}
+	for name, gpu_limits := range container.Resources.Limits {
+		if c.isGpuResource(name) && meetsGpuThreshold(container, name, gpu_limits, c) {
+			return true
+		}
+	}
+	for name, gpu_requests := range container.Resources.Requests {
+		if c.isGpuResource(name) && meetsGpuThreshold(container, name, gpu_requests, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// meetsGpuThreshold reports whether the GPU quantity makes a GPU container, that is it is at least GpuThreshold.
+// Without a threshold any positive quantity, fractional ones such as "500m" included, makes a GPU container.
+// A negative quantity is logged and treated like zero. Malformed quantities never get here, they already fail decoding the pod.
+func meetsGpuThreshold(container corev1.Container, name corev1.ResourceName, q resource.Quantity, c *config) bool {
+	if q.Sign() < 0 {
+		slog.Warn("Ignoring a negative GPU quantity", "container", container.Name, "resource", name, "quantity", q.String())
+		return false
+	}
+	if c.GpuThreshold != nil {
+		return q.Cmp(*c.GpuThreshold) >= 0
+	}
+	return q.Sign() > 0
+}
+
+// isGpuResource reports whether the resource is listed in GpuResourceNames or matches one of GpuResourcePatterns.
+func (c *config) isGpuResource(name corev1.ResourceName) bool {
+	if containsString(c.GpuResourceNames, string(name)) {
+		return true
+	}
+	for _, pattern := range c.GpuResourcePatterns {
+		if matchResourcePattern(pattern, string(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchResourcePattern matches the resource name against a pattern with a leading and/or trailing "*",
+// such as "*.com/gpu" or "gpu.intel.com/*". A pattern without "*" matches the name exactly.
+func matchResourcePattern(pattern, name string) bool {
+	prefix := strings.HasPrefix(pattern, "*")
+	suffix := strings.HasSuffix(pattern, "*")
+	pattern = strings.Trim(pattern, "*")
+	switch {
+	case prefix && suffix:
+		return strings.Contains(name, pattern)
+	case prefix:
+		return strings.HasSuffix(name, pattern)
+	case suffix:
+		return strings.HasPrefix(name, pattern)
+	default:
+		return name == pattern
+	}
+}
+
+// configmapToConfig parses the config stored under -configmap-key. A missing or blank key is an error
+// rather than an empty config, so a typo in the ConfigMap doesn't silently disable the policy.
 func configmapToConfig(configmap *corev1.ConfigMap) (*config, error) {
-	var c config
-	err := yaml.Unmarshal([]byte(configmap.Data["config"]), &c)
+	data, err := configmapData(configmap)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// configmapData returns the config stored under -configmap-key.
+func configmapData(configmap *corev1.ConfigMap) ([]byte, error) {
+	data, ok := configmap.Data[configmapKey]
+	if !ok {
+		return nil, fmt.Errorf("%w: configmap %s/%s has no %q key", ErrConfigMissing, configmap.Namespace, configmap.Name, configmapKey)
+	}
+	if strings.TrimSpace(data) == "" {
+		return nil, fmt.Errorf("%w: configmap %s/%s has an empty %q key", ErrConfigMissing, configmap.Namespace, configmap.Name, configmapKey)
+	}
+	return []byte(data), nil
+}
+
+// configParsers decode the JSON form of each config schema version into a config.
+// A new schema version gets its own parser converting it to the current config.
+var configParsers = map[string]func(data []byte) (*config, error){
+	configV1alpha1: parseConfigV1alpha1,
+}
+
+// parseConfig parses and validates the YAML config, filling in the defaults.
+// It is shared by the ConfigMap and the -config-file loaders.
+func parseConfig(bs []byte) (*config, error) {
+	data, err := yaml.YAMLToJSON(bs)
 	if err != nil {
 		return nil, err
 	}
+	var version struct {
+		APIVersion string
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if version.APIVersion == "" {
+		version.APIVersion = configV1alpha1
+	}
+	parse, ok := configParsers[version.APIVersion]
+	if !ok {
+		return nil, invalidField("apiVersion", "unknown version %q, must be %s", version.APIVersion, configV1alpha1)
+	}
+	c, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEnvOverrides(c, os.Getenv); err != nil {
+		return nil, err
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if c.IgnoreNamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(c.IgnoreNamespaceSelector)
+		if err != nil {
+			return nil, invalidField("ignoreNamespaceSelector", "%s", err)
+		}
+		c.ignoreNamespaceSelector = selector
+	}
+	if c.PodSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(c.PodSelector)
+		if err != nil {
+			return nil, invalidField("podSelector", "%s", err)
+		}
+		c.podSelector = selector
+	}
+	for i, v := range c.IgnoreNamespaceRegexes {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, invalidField(fmt.Sprintf("ignoreNamespaceRegexes[%d]", i), "%s", err)
+		}
+		c.ignoreNamespaceRegexes = append(c.ignoreNamespaceRegexes, re)
+	}
+	if c.InjectEnvName == "" {
+		c.InjectEnvName = defaultInjectEnvName
+	}
+	if c.InjectEnvValue == "" {
+		c.InjectEnvValue = defaultInjectEnvValue
+	}
+	if len(c.GpuResourceNames) == 0 {
+		c.GpuResourceNames = []string{defaultGpuResourceName}
+	}
+	if c.SkipAnnotation == "" {
+		c.SkipAnnotation = defaultSkipAnnotation
+	}
+	if c.MaskVolumeName == "" {
+		c.MaskVolumeName = defaultMaskVolumeName
+	}
+	return c, nil
+}
+
+// parseConfigV1alpha1 decodes a v1alpha1 config, which maps one to one to the config fields.
+func parseConfigV1alpha1(data []byte) (*config, error) {
+	c := config{IncludeInitContainers: true, PreserveOverhead: true, SkipMirrorPods: true}
+	// Reject unknown fields, a typo'd key would otherwise be silently ignored.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, invalidField(typeErr.Field, "can not use %s as %s", typeErr.Value, typeErr.Type)
+		}
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	c.APIVersion = configV1alpha1
 	return &c, nil
 }
 
-func applyNewPod(oldPod *corev1.Pod, newPod *corev1.Pod, clientset *kubernetes.Clientset) error {
-	oldData, err := json.Marshal(oldPod)
+// validate returns an error naming the offending field when the config is invalid.
+func (c *config) validate() error {
+	for i, v := range c.IgnoreNamespaces {
+		if v == "" {
+			return invalidField(fmt.Sprintf("ignoreNamespaces[%d]", i), "namespace must not be empty")
+		}
+	}
+	for i, v := range c.OnlyNamespaces {
+		if v == "" {
+			return invalidField(fmt.Sprintf("onlyNamespaces[%d]", i), "namespace must not be empty")
+		}
+	}
+	for i, v := range c.IgnoreOwnerKinds {
+		if v == "" {
+			return invalidField(fmt.Sprintf("ignoreOwnerKinds[%d]", i), "kind must not be empty")
+		}
+	}
+	for i, v := range c.IgnoreManagedBy {
+		if v == "" {
+			return invalidField(fmt.Sprintf("ignoreManagedBy[%d]", i), "manager must not be empty")
+		}
+	}
+	for i, v := range c.GpuResourceNames {
+		if v == "" {
+			return invalidField(fmt.Sprintf("gpuResourceNames[%d]", i), "resource name must not be empty")
+		}
+	}
+	if c.GpuThreshold != nil && c.GpuThreshold.Sign() <= 0 {
+		return invalidField("gpuThreshold", "%s must be positive", c.GpuThreshold.String())
+	}
+	for i, v := range c.GpuResourcePatterns {
+		if strings.Trim(v, "*") == "" || strings.Contains(strings.Trim(v, "*"), "*") {
+			return invalidField(fmt.Sprintf("gpuResourcePatterns[%d]", i), "%q must have a name with \"*\" only at its start or end", v)
+		}
+	}
+	injectEnvNames := map[string]bool{}
+	for i, v := range c.InjectEnvs {
+		if v.Name == "" {
+			return invalidField(fmt.Sprintf("injectEnvs[%d]", i), "name must not be empty")
+		}
+		if injectEnvNames[v.Name] {
+			return invalidField(fmt.Sprintf("injectEnvs[%d]", i), "duplicate name %s", v.Name)
+		}
+		injectEnvNames[v.Name] = true
+	}
+	for i, v := range c.ExtraEnv {
+		if v.Name == "" {
+			return invalidField(fmt.Sprintf("extraEnv[%d]", i), "name must not be empty")
+		}
+	}
+	for name := range c.InjectDefaultResources.Requests {
+		if name != corev1.ResourceCPU && name != corev1.ResourceMemory {
+			return invalidField("injectDefaultResources.requests", "only cpu and memory can be defaulted, not %s", name)
+		}
+	}
+	if len(c.InjectDefaultResources.Limits) > 0 {
+		return invalidField("injectDefaultResources.limits", "limits can not be defaulted, only requests")
+	}
+	for i, v := range c.InjectEnvFrom {
+		switch {
+		case (v.ConfigMapRef == nil) == (v.SecretRef == nil):
+			return invalidField(fmt.Sprintf("injectEnvFrom[%d]", i), "exactly one of configMapRef and secretRef must be set")
+		case v.ConfigMapRef != nil && v.ConfigMapRef.Name == "", v.SecretRef != nil && v.SecretRef.Name == "":
+			return invalidField(fmt.Sprintf("injectEnvFrom[%d]", i), "name must not be empty")
+		}
+	}
+	if c.InjectInitContainer != nil && (c.InjectInitContainer.Name == "" || c.InjectInitContainer.Image == "") {
+		return invalidField("injectInitContainer", "name and image must not be empty")
+	}
+	if c.MaskDevicePath != "" && !strings.HasPrefix(c.MaskDevicePath, "/") {
+		return invalidField("maskDevicePath", "%q must be an absolute path", c.MaskDevicePath)
+	}
+	for ns, o := range c.NamespaceOverrides {
+		for i, v := range o.GpuResourceNames {
+			if v == "" {
+				return invalidField(fmt.Sprintf("namespaceOverrides[%s].gpuResourceNames[%d]", ns, i), "resource name must not be empty")
+			}
+		}
+	}
+	return nil
+}
+
+// forNamespace returns the config for the pods in the namespace, with the namespace override
+// merged on top of the global config. Precedence is namespace override > global config > defaults, the
+// environment variables take precedence over all of them, see applyEnvOverrides.
+func (c *config) forNamespace(namespace string) *config {
+	o, ok := c.NamespaceOverrides[namespace]
+	if !ok {
+		return c
+	}
+	nc := *c
+	if o.InjectEnvValue != "" {
+		nc.InjectEnvValue = o.InjectEnvValue
+		// With InjectEnvs the override sets the value of its InjectEnvName env.
+		if len(c.InjectEnvs) > 0 {
+			nc.InjectEnvs = make([]corev1.EnvVar, len(c.InjectEnvs))
+			for i, e := range c.InjectEnvs {
+				if e.Name == c.InjectEnvName {
+					e = corev1.EnvVar{Name: e.Name, Value: o.InjectEnvValue}
+				}
+				nc.InjectEnvs[i] = e
+			}
+		}
+	}
+	if len(o.GpuResourceNames) > 0 {
+		nc.GpuResourceNames = o.GpuResourceNames
+	}
+	return &nc
+}
+
+// podResource is the subresource of the pod itself, the spec and metadata, as opposed to e.g. "status".
+const podResource = ""
+
+// applyNewPod patches the subresource of oldPod into newPod, podResource to patch the pod itself.
+func applyNewPod(ctx context.Context, oldPod *corev1.Pod, newPod *corev1.Pod, c *config, clientset kubernetes.Interface, subresource string) (err error) {
+	ctx, span := startPodSpan(ctx, "applyNewPod", oldPod)
+	defer func() { endSpan(span, err) }()
+
+	pt, patchBytes, err := createPatch(oldPod, newPod, patchType, c.PreserveOverhead)
 	if err != nil {
 		return err
 	}
+	checkPatchSize(oldPod, patchBytes)
+	span.SetAttributes(attribute.Int("patch.bytes", len(patchBytes)), attribute.String("patch.type", string(pt)), attribute.String("patch.subresource", subresource))
 
-	newData, err := json.Marshal(newPod)
+	// In dry run mode nothing is mutated, so the pod is left pending on this initializer.
+	if dryRun {
+		var out bytes.Buffer
+		if err := json.Indent(&out, patchBytes, "", "  "); err != nil {
+			return err
+		}
+		slog.Info("Dry run: not patching pod, its pending initializer is left in place", "pod", oldPod.Name, "namespace", oldPod.Namespace, "action", "dry-run", "patch", out.String())
+		return nil
+	}
+
+	// Retry transient failures, otherwise the pod would be stuck uninitialized.
+	backoff := retry.DefaultBackoff
+	backoff.Steps = patchAttempts
+	var patchErr error
+	attempts := 0
+	defer func() { span.SetAttributes(attribute.Int("patch.attempts", attempts)) }()
+	err = wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if err := patchLimiter.Wait(ctx); err != nil {
+			return false, err
+		}
+		attempts++
+		patchErr = patchPod(ctx, clientset, oldPod, subresource, pt, patchBytes)
+		if patchErr == nil {
+			return true, nil
+		}
+		// Requeue a throttled pod rather than retry it here, so the worker doesn't hold on to it while
+		// the API server is overloaded. The client already retried the requests that came with a Retry-After.
+		if apierrors.IsTooManyRequests(patchErr) {
+			throttled.Inc()
+			delay, _ := apierrors.SuggestsClientDelay(patchErr)
+			return false, &throttledError{delay: time.Duration(delay) * time.Second, err: patchErr}
+		}
+		if isRetriablePatchError(patchErr) {
+			slog.Warn("Patching pod failed, retrying", "pod", oldPod.Name, "namespace", oldPod.Namespace, "error", patchErr)
+			return false, nil
+		}
+		return false, patchErr
+	})
+	if err == wait.ErrWaitTimeout {
+		err = patchErr
+	}
+	if _, ok := err.(*throttledError); ok {
+		slog.Warn("Patching pod was throttled, requeueing", "pod", oldPod.Name, "namespace", oldPod.Namespace, "error", patchErr)
+		return &PatchError{Namespace: oldPod.Namespace, Name: oldPod.Name, Err: err}
+	}
 	if err != nil {
+		patchErrors.Inc()
+		return &PatchError{Namespace: oldPod.Namespace, Name: oldPod.Name, Err: err}
+	}
+	audit.log(auditEntry{
+		Time:       time.Now().UTC(),
+		Namespace:  oldPod.Namespace,
+		Pod:        oldPod.Name,
+		Containers: changedContainers(oldPod, newPod),
+		PatchType:  string(pt),
+		Patch:      patchBytes,
+	})
+	return nil
+}
+
+// checkPatchSize logs the patch size and warns when the patch is large enough to approach the API server
+// request size limit.
+func checkPatchSize(pod *corev1.Pod, patchBytes []byte) {
+	slog.Debug("Computed pod patch", "pod", pod.Name, "namespace", pod.Namespace, "bytes", len(patchBytes))
+	if len(patchBytes) > largePatchBytes {
+		slog.Warn("Pod patch is large", "pod", pod.Name, "namespace", pod.Namespace, "bytes", len(patchBytes), "large-patch-bytes", largePatchBytes)
+		largePatches.Inc()
+	}
+}
+
+// patchPod patches the subresource of the pod, the pod itself for podResource. The clientset bounds
+// the request by -api-timeout, a cancelled context stops the pod from being patched at all.
+func patchPod(ctx context.Context, clientset kubernetes.Interface, pod *corev1.Pod, subresource string, pt types.PatchType, patchBytes []byte) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, corev1.Pod{})
+	var subresources []string
+	if subresource != podResource {
+		subresources = append(subresources, subresource)
+	}
+	_, err := clientset.CoreV1().Pods(pod.Namespace).Patch(pod.Name, pt, patchBytes, subresources...)
+	return err
+}
+
+// createPatch returns the patch of the given type that turns oldPod into newPod,
+// either a strategic merge patch or an RFC 6902 JSON patch. The strategic merge patch
+// merges containers and envs by name, so edits to several containers all land in one patch.
+// With preserveOverhead any change to spec.overhead is stripped from the patch, see stripOverhead.
+func createPatch(oldPod *corev1.Pod, newPod *corev1.Pod, patchType string, preserveOverhead bool) (types.PatchType, []byte, error) {
+	pt, patchBytes, err := createPodPatch(oldPod, newPod, patchType)
+	if err != nil || !preserveOverhead {
+		return pt, patchBytes, err
+	}
+	patchBytes, err = stripOverhead(pt, patchBytes)
+	return pt, patchBytes, err
+}
+
+func createPodPatch(oldPod *corev1.Pod, newPod *corev1.Pod, patchType string) (types.PatchType, []byte, error) {
+	oldData, err := json.Marshal(oldPod)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
-	_, err = clientset.CoreV1().Pods(oldPod.Namespace).Patch(oldPod.Name, types.StrategicMergePatchType, patchBytes)
+	newData, err := json.Marshal(newPod)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	return nil
+
+	if patchType == patchTypeJSON {
+		ops, err := jsonpatch.CreatePatch(oldData, newData)
+		if err != nil {
+			return "", nil, err
+		}
+		// An empty patch is an empty list, not null.
+		if ops == nil {
+			ops = []jsonpatch.Operation{}
+		}
+		patchBytes, err := json.Marshal(ops)
+		return types.JSONPatchType, patchBytes, err
+	}
+
+	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, corev1.Pod{})
+	return types.StrategicMergePatchType, patchBytes, err
+}
+
+// overheadPath is the JSON pointer of the pod overhead, counted by the scheduler on top of the container requests.
+const overheadPath = "/spec/overhead"
+
+// stripOverhead removes the changes to spec.overhead from the patch, so the injection never disturbs the pod
+// overhead a cluster may use for GPU accounting. The Pod API types this initializer is built against predate
+// the overhead field, so the patches of the decoded pods never include it, this guards against that changing.
+func stripOverhead(pt types.PatchType, patchBytes []byte) ([]byte, error) {
+	if pt == types.JSONPatchType {
+		ops := []map[string]interface{}{}
+		if err := json.Unmarshal(patchBytes, &ops); err != nil {
+			return nil, err
+		}
+		kept := []map[string]interface{}{}
+		for _, op := range ops {
+			if path, _ := op["path"].(string); path == overheadPath || strings.HasPrefix(path, overheadPath+"/") {
+				slog.Warn("Stripping a change to the pod overhead from the patch", "op", op["op"], "path", path)
+				continue
+			}
+			kept = append(kept, op)
+		}
+		if len(kept) == len(ops) {
+			return patchBytes, nil
+		}
+		return json.Marshal(kept)
+	}
+
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(patchBytes, &patch); err != nil {
+		return nil, err
+	}
+	spec, ok := patch["spec"].(map[string]interface{})
+	if !ok {
+		return patchBytes, nil
+	}
+	if _, ok := spec["overhead"]; !ok {
+		return patchBytes, nil
+	}
+	slog.Warn("Stripping a change to the pod overhead from the patch", "path", overheadPath)
+	delete(spec, "overhead")
+	if len(spec) == 0 {
+		delete(patch, "spec")
+	}
+	return json.Marshal(patch)
+}
+
+// isRetriablePatchError reports whether a failed patch may succeed when retried.
+// Validation errors are not retried, since they fail the same way every time.
+func isRetriablePatchError(err error) bool {
+	return apierrors.IsConflict(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err)
 } 
@@ -0,0 +1,2303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	evanjsonpatch "github.com/evanphx/json-patch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+const testNamespace = "default"
+
+// TestMain sets the flags the code under test reads to their defaults, main() registers them.
+func TestMain(m *testing.M) {
+	initializerName = defaultInitializerName
+	configmap = defaultConfigmap
+	configmapKey = defaultConfigmapKey
+	namespace = "gpu-initializer"
+	patchType = patchTypeStrategic
+	patchAttempts = defaultPatchAttempts
+	maxRetries = defaultMaxRetries
+	workers = defaultWorkers
+	apiTimeout = defaultAPITimeout
+	largePatchBytes = defaultLargePatchBytes
+	protectedNamespaceList = splitList(defaultProtectedNamespaces)
+	os.Exit(m.Run())
+}
+
+// setFlag sets a flag for the duration of the test.
+func setFlag[T any](t *testing.T, flag *T, v T) {
+	t.Helper()
+	old := *flag
+	*flag = v
+	t.Cleanup(func() { *flag = old })
+}
+
+// newTestConfig parses the YAML config, failing the test when it is invalid.
+func newTestConfig(t *testing.T, data string) *config {
+	t.Helper()
+	c, err := parseConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("parseConfig(%q) error: %v", data, err)
+	}
+	return c
+}
+
+// newTestPod returns a pod of the test namespace pending on the initializer.
+func newTestPod(name string, containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Initializers: &metav1.Initializers{
+				Pending: []metav1.Initializer{{Name: defaultInitializerName}},
+			},
+		},
+		Spec: corev1.PodSpec{Containers: containers},
+	}
+}
+
+func newTestContainer(name string) corev1.Container {
+	return corev1.Container{Name: name, Image: "busybox"}
+}
+
+// newGpuContainer returns a container with a limit of one nvidia.com/gpu.
+func newGpuContainer(name string) corev1.Container {
+	container := newTestContainer(name)
+	container.Resources.Limits = corev1.ResourceList{defaultGpuResourceName: resource.MustParse("1")}
+	return container
+}
+
+// newTestClientset returns a fake clientset holding the objects. The fake applies a pod patch onto the
+// stored pod, so the fields the patch removes would be kept, its pod patches are applied onto a new pod.
+// The actions don't record the patch type, a patch that is a list is applied as a JSON patch.
+func newTestClientset(objects ...runtime.Object) *fake.Clientset {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	clientset.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := tracker.Watch(action.GetResource(), action.GetNamespace())
+		return err == nil, w, err
+	})
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		gvr := patch.GetResource()
+		obj, err := tracker.Get(gvr, patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		old, err := json.Marshal(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		var patched []byte
+		if bytes.HasPrefix(patch.GetPatch(), []byte("[")) {
+			ops, err := evanjsonpatch.DecodePatch(patch.GetPatch())
+			if err != nil {
+				return true, nil, err
+			}
+			patched, err = ops.Apply(old)
+		} else {
+			patched, err = strategicpatch.StrategicMergePatch(old, patch.GetPatch(), &corev1.Pod{})
+		}
+		if err != nil {
+			return true, nil, err
+		}
+		pod := &corev1.Pod{}
+		if err := json.Unmarshal(patched, pod); err != nil {
+			return true, nil, err
+		}
+		return true, pod, tracker.Update(gvr, pod, patch.GetNamespace())
+	})
+	return clientset
+}
+
+// getTestPod returns the pod as stored by the fake clientset.
+func getTestPod(t *testing.T, clientset *fake.Clientset, pod *corev1.Pod) *corev1.Pod {
+	t.Helper()
+	got, err := clientset.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return got
+}
+
+// patchActions returns the pod patches the fake clientset received.
+func patchActions(clientset *fake.Clientset) []k8stesting.PatchAction {
+	actions := []k8stesting.PatchAction{}
+	for _, a := range clientset.Actions() {
+		if p, ok := a.(k8stesting.PatchAction); ok && a.GetResource().Resource == "pods" {
+			actions = append(actions, p)
+		}
+	}
+	return actions
+}
+
+// failPatches makes the first n pod patches of the fake clientset fail with err, all of them when n is negative.
+func failPatches(clientset *fake.Clientset, n int, err error) {
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if n == 0 {
+			return false, nil, nil
+		}
+		n--
+		return true, nil, err
+	})
+}
+
+// applyJSONPatch applies the JSON patch to the pod, failing the test when it doesn't apply.
+func applyJSONPatch(t *testing.T, pod *corev1.Pod, patch []byte) *corev1.Pod {
+	t.Helper()
+	ops, err := evanjsonpatch.DecodePatch(patch)
+	if err != nil {
+		t.Fatalf("decoding the JSON patch %s: %v", patch, err)
+	}
+	data, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := ops.Apply(data)
+	if err != nil {
+		t.Fatalf("applying the JSON patch %s: %v", patch, err)
+	}
+	got := &corev1.Pod{}
+	if err := json.Unmarshal(patched, got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// envValue returns the value of the env of the container of the pod.
+func envValue(pod *corev1.Pod, container, name string) (string, bool) {
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		if c.Name != container {
+			continue
+		}
+		for _, e := range c.Env {
+			if e.Name == name {
+				return e.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+func TestInitializePod(t *testing.T) {
+	deleting := newTestPod("deleting", newTestContainer("app"))
+	deleting.DeletionTimestamp = &metav1.Time{}
+	otherFirst := newTestPod("other-first", newTestContainer("app"))
+	otherFirst.Initializers.Pending = []metav1.Initializer{{Name: "other.example.com"}, {Name: defaultInitializerName}}
+	othersAfter := newTestPod("others-after", newTestContainer("app"))
+	othersAfter.Initializers.Pending = []metav1.Initializer{{Name: defaultInitializerName}, {Name: "other.example.com"}}
+
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		// The env value expected in each container, empty when the env must not be set.
+		wantEnv     map[string]string
+		wantPending []string
+		wantPatched bool
+		wantEvent   bool
+	}{
+		{
+			name:        "injects the containers without a GPU",
+			pod:         newTestPod("mixed", newTestContainer("app"), newGpuContainer("cuda")),
+			wantEnv:     map[string]string{"app": defaultInjectEnvValue, "cuda": ""},
+			wantPatched: true,
+			wantEvent:   true,
+		},
+		{
+			name:        "removes the initializer of a GPU pod without injecting",
+			pod:         newTestPod("gpu", newGpuContainer("cuda")),
+			wantEnv:     map[string]string{"cuda": ""},
+			wantPatched: true,
+		},
+		{
+			name:        "only removes the initializer of a pod being deleted",
+			pod:         deleting,
+			wantEnv:     map[string]string{"app": ""},
+			wantPatched: true,
+		},
+		{
+			name:        "leaves a pod pending on another initializer first alone",
+			pod:         otherFirst,
+			wantEnv:     map[string]string{"app": ""},
+			wantPending: []string{"other.example.com", defaultInitializerName},
+		},
+		{
+			name:        "keeps the initializers pending after it",
+			pod:         othersAfter,
+			wantEnv:     map[string]string{"app": defaultInjectEnvValue},
+			wantPending: []string{"other.example.com"},
+			wantPatched: true,
+			wantEvent:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := newTestClientset(tt.pod)
+			recorder := record.NewFakeRecorder(10)
+
+			if err := initializePod(context.Background(), tt.pod, newTestConfig(t, ""), clientset, recorder); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+
+			if got := len(patchActions(clientset)) > 0; got != tt.wantPatched {
+				t.Errorf("initializePod() patched the pod: %v, want %v", got, tt.wantPatched)
+			}
+			got := getTestPod(t, clientset, tt.pod)
+			for container, want := range tt.wantEnv {
+				if v, _ := envValue(got, container, defaultInjectEnvName); v != want {
+					t.Errorf("container %s %s = %q, want %q", container, defaultInjectEnvName, v, want)
+				}
+			}
+			pending := []string{}
+			if got.Initializers != nil {
+				for _, v := range got.Initializers.Pending {
+					pending = append(pending, v.Name)
+				}
+			}
+			if len(pending) != len(tt.wantPending) {
+				t.Fatalf("pending initializers = %v, want %v", pending, tt.wantPending)
+			}
+			for i := range pending {
+				if pending[i] != tt.wantPending[i] {
+					t.Errorf("pending initializers = %v, want %v", pending, tt.wantPending)
+				}
+			}
+			if got := len(recorder.Events) > 0; got != tt.wantEvent {
+				t.Errorf("initializePod() recorded an event: %v, want %v", got, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestInitializePodDryRun(t *testing.T) {
+	setFlag(t, &dryRun, true)
+	pod := newTestPod("dry-run", newTestContainer("app"))
+	clientset := newTestClientset(pod)
+	recorder := record.NewFakeRecorder(10)
+
+	if err := initializePod(context.Background(), pod, newTestConfig(t, ""), clientset, recorder); err != nil {
+		t.Fatalf("initializePod() error: %v", err)
+	}
+	if actions := patchActions(clientset); len(actions) != 0 {
+		t.Errorf("initializePod() patched the pod in dry run mode: %v", actions)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("initializePod() recorded an event in dry run mode")
+	}
+}
+
+func TestApplyNewPod(t *testing.T) {
+	notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "app")
+	invalid := apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, "app", field.ErrorList{field.Invalid(field.NewPath("spec"), nil, "invalid")})
+	unavailable := apierrors.NewServiceUnavailable("unavailable")
+
+	tests := []struct {
+		name        string
+		failures    int
+		err         error
+		wantPatches int
+		wantErr     bool
+		// Whether the returned PatchError is permanent.
+		wantPermanent bool
+	}{
+		{
+			name:        "patches the pod",
+			wantPatches: 1,
+		},
+		{
+			name:        "retries a transient failure",
+			failures:    2,
+			err:         unavailable,
+			wantPatches: 3,
+		},
+		{
+			name:        "gives up after -patch-attempts",
+			failures:    defaultPatchAttempts,
+			err:         unavailable,
+			wantPatches: defaultPatchAttempts,
+			wantErr:     true,
+		},
+		{
+			name:          "does not retry a rejected patch",
+			failures:      1,
+			err:           invalid,
+			wantPatches:   1,
+			wantErr:       true,
+			wantPermanent: true,
+		},
+		{
+			name:          "does not retry a deleted pod",
+			failures:      1,
+			err:           notFound,
+			wantPatches:   1,
+			wantErr:       true,
+			wantPermanent: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldPod := newTestPod("app", newTestContainer("app"))
+			newPod := oldPod.DeepCopy()
+			newPod.Initializers = nil
+			newPod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: defaultInjectEnvName, Value: defaultInjectEnvValue}}
+			clientset := newTestClientset(oldPod)
+			failPatches(clientset, tt.failures, tt.err)
+
+			err := applyNewPod(context.Background(), oldPod, newPod, newTestConfig(t, ""), clientset, podResource)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyNewPod() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				var patchErr *PatchError
+				if !errors.As(err, &patchErr) {
+					t.Fatalf("applyNewPod() error = %v, want a *PatchError", err)
+				}
+				if patchErr.Permanent() != tt.wantPermanent {
+					t.Errorf("PatchError.Permanent() = %v, want %v", patchErr.Permanent(), tt.wantPermanent)
+				}
+			}
+
+			actions := patchActions(clientset)
+			if len(actions) != tt.wantPatches {
+				t.Fatalf("applyNewPod() sent %d patches, want %d", len(actions), tt.wantPatches)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := getTestPod(t, clientset, oldPod)
+			if got.Initializers != nil {
+				t.Errorf("pod still has initializers %v", got.Initializers)
+			}
+			if v, _ := envValue(got, "app", defaultInjectEnvName); v != defaultInjectEnvValue {
+				t.Errorf("container app %s = %q, want %q", defaultInjectEnvName, v, defaultInjectEnvValue)
+			}
+		})
+	}
+}
+
+func TestApplyNewPodDryRun(t *testing.T) {
+	setFlag(t, &dryRun, true)
+	oldPod := newTestPod("app", newTestContainer("app"))
+	newPod := oldPod.DeepCopy()
+	newPod.Initializers = nil
+	clientset := newTestClientset(oldPod)
+
+	if err := applyNewPod(context.Background(), oldPod, newPod, newTestConfig(t, ""), clientset, podResource); err != nil {
+		t.Fatalf("applyNewPod() error: %v", err)
+	}
+	if actions := patchActions(clientset); len(actions) != 0 {
+		t.Errorf("applyNewPod() patched the pod in dry run mode: %v", actions)
+	}
+}
+
+func TestChangedContainers(t *testing.T) {
+	injected := newTestContainer("app")
+	injected.Env = []corev1.EnvVar{{Name: defaultInjectEnvName, Value: defaultInjectEnvValue}}
+
+	tests := []struct {
+		name     string
+		old, new corev1.PodSpec
+		want     []string
+	}{
+		{
+			name: "unchanged",
+			old:  corev1.PodSpec{Containers: []corev1.Container{newTestContainer("app")}},
+			new:  corev1.PodSpec{Containers: []corev1.Container{newTestContainer("app")}},
+			want: []string{},
+		},
+		{
+			name: "changed container",
+			old:  corev1.PodSpec{Containers: []corev1.Container{newTestContainer("app"), newTestContainer("sidecar")}},
+			new:  corev1.PodSpec{Containers: []corev1.Container{injected, newTestContainer("sidecar")}},
+			want: []string{"app"},
+		},
+		{
+			name: "prepended init container",
+			old: corev1.PodSpec{
+				InitContainers: []corev1.Container{newTestContainer("setup")},
+				Containers:     []corev1.Container{newTestContainer("app")},
+			},
+			new: corev1.PodSpec{
+				InitContainers: []corev1.Container{newTestContainer("gpu-cleanup"), newTestContainer("setup")},
+				Containers:     []corev1.Container{injected},
+			},
+			want: []string{"gpu-cleanup", "app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := changedContainers(&corev1.Pod{Spec: tt.old}, &corev1.Pod{Spec: tt.new})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedContainers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectPodInitContainer(t *testing.T) {
+	c := newTestConfig(t, `
+injectInitContainer:
+  name: gpu-cleanup
+  image: busybox
+`)
+	pod := newTestPod("app", newTestContainer("app"))
+
+	result, err := injectPod(context.Background(), pod, c, newTestClientset(pod))
+	if err != nil {
+		t.Fatalf("injectPod() error: %v", err)
+	}
+	if want := []string{"gpu-cleanup", "app"}; !reflect.DeepEqual(result.containers, want) {
+		t.Errorf("injectPod() containers = %v, want %v", result.containers, want)
+	}
+	if len(pod.Spec.InitContainers) != 1 || pod.Spec.InitContainers[0].Name != "gpu-cleanup" {
+		t.Errorf("init containers = %v, want gpu-cleanup", pod.Spec.InitContainers)
+	}
+}
+
+func TestCreatePatchJSON(t *testing.T) {
+	withEnv := func(pod *corev1.Pod, env ...corev1.EnvVar) *corev1.Pod {
+		pod = pod.DeepCopy()
+		pod.Spec.Containers[0].Env = env
+		return pod
+	}
+	withArgs := func(pod *corev1.Pod, args ...string) *corev1.Pod {
+		pod = pod.DeepCopy()
+		pod.Spec.Containers[0].Args = args
+		return pod
+	}
+	env := func(name, value string) corev1.EnvVar {
+		return corev1.EnvVar{Name: name, Value: value}
+	}
+	pod := newTestPod("app", newTestContainer("app"), newTestContainer("sidecar"))
+	initialized := pod.DeepCopy()
+	initialized.Initializers = nil
+
+	tests := []struct {
+		name     string
+		old, new *corev1.Pod
+	}{
+		{
+			name: "adds an env",
+			old:  pod,
+			new:  withEnv(pod, env(defaultInjectEnvName, defaultInjectEnvValue)),
+		},
+		{
+			name: "replaces the inject envs in the middle of the list",
+			old:  withEnv(pod, env(defaultInjectEnvName, "all"), env("A", "a"), env(defaultInjectEnvName, "0"), env("B", "b")),
+			new:  withEnv(pod, env("A", "a"), env("B", "b"), env(defaultInjectEnvName, defaultInjectEnvValue)),
+		},
+		{
+			name: "removes elements from the middle of a list",
+			old:  withArgs(pod, "1", "2", "3", "4", "5"),
+			new:  withArgs(pod, "1", "5"),
+		},
+		{
+			name: "removes the initializers",
+			old:  pod,
+			new:  initialized,
+		},
+		{
+			name: "no change",
+			old:  pod,
+			new:  pod,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt, patch, err := createPatch(tt.old, tt.new, patchTypeJSON, true)
+			if err != nil {
+				t.Fatalf("createPatch() error: %v", err)
+			}
+			if pt != types.JSONPatchType {
+				t.Errorf("createPatch() patch type = %s, want %s", pt, types.JSONPatchType)
+			}
+			if got := applyJSONPatch(t, tt.old, patch); !apiequality.Semantic.DeepEqual(got, tt.new) {
+				t.Errorf("applying the patch %s gives\n%+v\nwant\n%+v", patch, got.Spec, tt.new.Spec)
+			}
+		})
+	}
+}
+
+func TestCreatePatchRoundTrip(t *testing.T) {
+	oldPod := newTestPod("app", newTestContainer("app"), newGpuContainer("cuda"), newTestContainer("sidecar"))
+	oldPod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "A", Value: "a"}, {Name: defaultInjectEnvName, Value: "all"}, {Name: "B", Value: "b"}}
+	oldPod.Spec.Containers[2].Args = []string{"1", "2", "3", "4", "5"}
+	oldPod.Initializers.Pending = append(oldPod.Initializers.Pending, metav1.Initializer{Name: "other.example.com"})
+
+	newPod := oldPod.DeepCopy()
+	newPod.Initializers.Pending = newPod.Initializers.Pending[1:]
+	newPod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "A", Value: "a"}, {Name: "B", Value: "b"}, {Name: defaultInjectEnvName, Value: defaultInjectEnvValue}}
+	newPod.Spec.Containers[2].Env = []corev1.EnvVar{{Name: defaultInjectEnvName, Value: defaultInjectEnvValue}}
+	newPod.Spec.Containers[2].Args = []string{"1", "5"}
+	newPod.Spec.Tolerations = []corev1.Toleration{{Key: "gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}}
+
+	// Each patch type must turn the stored pod into the same pod.
+	patched := map[string]*corev1.Pod{}
+	for _, pt := range []string{patchTypeStrategic, patchTypeJSON} {
+		t.Run(pt, func(t *testing.T) {
+			setFlag(t, &patchType, pt)
+			clientset := newTestClientset(oldPod)
+
+			if err := applyNewPod(context.Background(), oldPod, newPod, newTestConfig(t, ""), clientset, podResource); err != nil {
+				t.Fatalf("applyNewPod() error: %v", err)
+			}
+			got := getTestPod(t, clientset, oldPod)
+			if !apiequality.Semantic.DeepEqual(got.Spec, newPod.Spec) || !apiequality.Semantic.DeepEqual(got.Initializers, newPod.Initializers) {
+				t.Errorf("patched pod = %+v, want %+v", got, newPod)
+			}
+			patched[pt] = got
+		})
+	}
+	if !apiequality.Semantic.DeepEqual(patched[patchTypeStrategic], patched[patchTypeJSON]) {
+		t.Errorf("the JSON patch gives %+v, the strategic merge patch %+v", patched[patchTypeJSON], patched[patchTypeStrategic])
+	}
+}
+
+func TestCreatePatchContainers(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want string
+	}{
+		{
+			name: "one of two containers has a GPU",
+			pod:  newTestPod("app", newTestContainer("app"), newGpuContainer("cuda")),
+			want: `{"spec":{"$setElementOrder/containers":[{"name":"app"},{"name":"cuda"}],` +
+				`"containers":[{"env":[{"name":"NVIDIA_VISIBLE_DEVICES","value":"none"}],"name":"app"}]}}`,
+		},
+		{
+			name: "containers on both sides of a GPU container",
+			pod:  newTestPod("app", newTestContainer("app"), newGpuContainer("cuda"), newTestContainer("sidecar")),
+			want: `{"spec":{"$setElementOrder/containers":[{"name":"app"},{"name":"cuda"},{"name":"sidecar"}],` +
+				`"containers":[{"env":[{"name":"NVIDIA_VISIBLE_DEVICES","value":"none"}],"name":"app"},` +
+				`{"env":[{"name":"NVIDIA_VISIBLE_DEVICES","value":"none"}],"name":"sidecar"}]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(t, "")
+			mutatedPod, err := mutatePodSpec(tt.pod.DeepCopy(), c.forPod(tt.pod))
+			if err != nil {
+				t.Fatalf("mutatePodSpec() error: %v", err)
+			}
+			_, patch, err := createPatch(tt.pod, mutatedPod, patchTypeStrategic, c.PreserveOverhead)
+			if err != nil {
+				t.Fatalf("createPatch() error: %v", err)
+			}
+			if string(patch) != tt.want {
+				t.Errorf("createPatch() = %s, want %s", patch, tt.want)
+			}
+		})
+	}
+}
+
+// resourceList returns the resource list of the name and quantity pairs.
+func resourceList(pairs ...string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	for i := 0; i < len(pairs); i += 2 {
+		list[corev1.ResourceName(pairs[i])] = resource.MustParse(pairs[i+1])
+	}
+	return list
+}
+
+func TestSetDefaultResources(t *testing.T) {
+	c := newTestConfig(t, `
+injectDefaultResources:
+  requests:
+    cpu: 100m
+    memory: 128Mi
+`)
+
+	tests := []struct {
+		name      string
+		resources corev1.ResourceRequirements
+		want      corev1.ResourceRequirements
+	}{
+		{
+			name: "no resources",
+			want: corev1.ResourceRequirements{Requests: resourceList("cpu", "100m", "memory", "128Mi")},
+		},
+		{
+			name:      "partial requests",
+			resources: corev1.ResourceRequirements{Requests: resourceList("cpu", "2")},
+			want:      corev1.ResourceRequirements{Requests: resourceList("cpu", "2", "memory", "128Mi")},
+		},
+		{
+			name:      "all requests set",
+			resources: corev1.ResourceRequirements{Requests: resourceList("cpu", "2", "memory", "1Gi")},
+			want:      corev1.ResourceRequirements{Requests: resourceList("cpu", "2", "memory", "1Gi")},
+		},
+		{
+			name:      "limit without a request",
+			resources: corev1.ResourceRequirements{Limits: resourceList("memory", "64Mi")},
+			want: corev1.ResourceRequirements{
+				Requests: resourceList("cpu", "100m"),
+				Limits:   resourceList("memory", "64Mi"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := newTestContainer("app")
+			container.Resources = tt.resources
+			setDefaultResources(&container, c)
+			if !apiequality.Semantic.DeepEqual(container.Resources, tt.want) {
+				t.Errorf("setDefaultResources() = %+v, want %+v", container.Resources, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectDefaultResourcesGpuContainer(t *testing.T) {
+	c := newTestConfig(t, `
+injectDefaultResources:
+  requests:
+    cpu: 100m
+`)
+	pod := newTestPod("app", newTestContainer("app"), newGpuContainer("cuda"))
+
+	mutatedPod, err := mutatePodSpec(pod.DeepCopy(), c.forPod(pod))
+	if err != nil {
+		t.Fatalf("mutatePodSpec() error: %v", err)
+	}
+	if got := mutatedPod.Spec.Containers[0].Resources.Requests; !apiequality.Semantic.DeepEqual(got, resourceList("cpu", "100m")) {
+		t.Errorf("container app requests = %v, want cpu 100m", got)
+	}
+	if got := mutatedPod.Spec.Containers[1].Resources; !apiequality.Semantic.DeepEqual(got, pod.Spec.Containers[1].Resources) {
+		t.Errorf("GPU container cuda resources = %+v, want them untouched", got)
+	}
+}
+
+func TestParseConfigDefaultResourceLimits(t *testing.T) {
+	_, err := parseConfig([]byte(`
+injectDefaultResources:
+  limits:
+    memory: 1Gi
+`))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "injectDefaultResources.limits" {
+		t.Errorf("parseConfig() error = %v, want a ValidationError of injectDefaultResources.limits", err)
+	}
+}
+
+func TestInitializePodCounters(t *testing.T) {
+	compliant := newTestPod("compliant", newTestContainer("app"))
+	compliant.Spec.Containers[0].Env = []corev1.EnvVar{{Name: defaultInjectEnvName, Value: defaultInjectEnvValue}}
+	skipped := newTestPod("skipped", newTestContainer("app"))
+	skipped.Annotations = map[string]string{defaultSkipAnnotation: "true"}
+
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		dryRun bool
+		// How many patches fail, the pod is initialized again until one goes through.
+		failures      int
+		wantInjected  float64
+		wantDrift     float64
+		wantCompliant float64
+		wantIgnored   float64
+	}{
+		{
+			name:         "injected pod",
+			pod:          newTestPod("injected", newTestContainer("app")),
+			wantInjected: 1,
+			wantDrift:    1,
+		},
+		{
+			name:          "already compliant pod",
+			pod:           compliant,
+			wantCompliant: 1,
+		},
+		{
+			name:        "ignored pod",
+			pod:         skipped,
+			wantIgnored: 1,
+		},
+		{
+			name:   "dry run",
+			pod:    newTestPod("dry-run", newTestContainer("app")),
+			dryRun: true,
+		},
+		{
+			name:         "retried pod",
+			pod:          newTestPod("retried", newTestContainer("app")),
+			failures:     2 * defaultPatchAttempts,
+			wantInjected: 1,
+			wantDrift:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &dryRun, tt.dryRun)
+			clientset := newTestClientset(tt.pod)
+			failPatches(clientset, tt.failures, apierrors.NewServiceUnavailable("unavailable"))
+			injected, drift, compliant, ignored := testutil.ToFloat64(podsInjected), testutil.ToFloat64(driftFixed), testutil.ToFloat64(alreadyCompliant), testutil.ToFloat64(podsIgnored)
+
+			for i := 0; ; i++ {
+				err := initializePod(context.Background(), tt.pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10))
+				if err == nil {
+					break
+				}
+				if i*defaultPatchAttempts >= tt.failures {
+					t.Fatalf("initializePod() error: %v", err)
+				}
+			}
+
+			for _, c := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"pods injected", testutil.ToFloat64(podsInjected) - injected, tt.wantInjected},
+				{"drift fixed", testutil.ToFloat64(driftFixed) - drift, tt.wantDrift},
+				{"already compliant", testutil.ToFloat64(alreadyCompliant) - compliant, tt.wantCompliant},
+				{"pods ignored", testutil.ToFloat64(podsIgnored) - ignored, tt.wantIgnored},
+			} {
+				if c.got != c.want {
+					t.Errorf("%s counted %v times, want %v", c.name, c.got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveNamespace(t *testing.T) {
+	namespaceFile := filepath.Join(t.TempDir(), "namespace")
+	if err := ioutil.WriteFile(namespaceFile, []byte("from-file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missingFile := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name          string
+		flag          string
+		namespaceFile string
+		podNamespace  string
+		want          string
+		wantErr       bool
+	}{
+		{
+			name:          "the flag takes precedence",
+			flag:          "from-flag",
+			namespaceFile: namespaceFile,
+			podNamespace:  "from-env",
+			want:          "from-flag",
+		},
+		{
+			name:          "the namespace file comes next",
+			namespaceFile: namespaceFile,
+			podNamespace:  "from-env",
+			want:          "from-file",
+		},
+		{
+			name:          "POD_NAMESPACE without a namespace file",
+			namespaceFile: missingFile,
+			podNamespace:  "from-env",
+			want:          "from-env",
+		},
+		{
+			name:          "no namespace",
+			namespaceFile: missingFile,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(name string) string {
+				if name == "POD_NAMESPACE" {
+					return tt.podNamespace
+				}
+				return ""
+			}
+			got, err := resolveNamespace(tt.flag, tt.namespaceFile, getenv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveNamespace() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveNamespace() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// mutateTestPod returns the pod with the policy of the config applied, failing the test on an error.
+func mutateTestPod(t *testing.T, c *config, pod *corev1.Pod) *corev1.Pod {
+	t.Helper()
+	mutatedPod, err := mutatePodSpec(pod.DeepCopy(), c.forNamespace(pod.Namespace).forPod(pod))
+	if err != nil {
+		t.Fatalf("mutatePodSpec() error: %v", err)
+	}
+	return mutatedPod
+}
+
+func TestInjectEnvValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name: "empty falls back to none",
+			want: "none",
+		},
+		{
+			name:   "configured value",
+			config: "injectEnvValue: void",
+			want:   "void",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := mutateTestPod(t, newTestConfig(t, tt.config), newTestPod("app", newTestContainer("app")))
+			if got := pod.Spec.Containers[0].Env; !reflect.DeepEqual(got, []corev1.EnvVar{{Name: defaultInjectEnvName, Value: tt.want}}) {
+				t.Errorf("container env = %v, want %s=%s", got, defaultInjectEnvName, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitializePodSkipAnnotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		annotations map[string]string
+		wantEnv     string
+	}{
+		{
+			name:    "injects a pod without the annotation",
+			wantEnv: defaultInjectEnvValue,
+		},
+		{
+			name:        "injects a pod not opting out",
+			annotations: map[string]string{defaultSkipAnnotation: "false"},
+			wantEnv:     defaultInjectEnvValue,
+		},
+		{
+			name:        "skips a pod opting out",
+			annotations: map[string]string{defaultSkipAnnotation: "true"},
+		},
+		{
+			name:        "honours the configured annotation",
+			config:      "skipAnnotation: example.com/no-gpu-env",
+			annotations: map[string]string{"example.com/no-gpu-env": "true"},
+		},
+		{
+			name:        "ignores the default annotation once another one is configured",
+			config:      "skipAnnotation: example.com/no-gpu-env",
+			annotations: map[string]string{defaultSkipAnnotation: "true"},
+			wantEnv:     defaultInjectEnvValue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.Annotations = tt.annotations
+			clientset := newTestClientset(pod)
+
+			if err := initializePod(context.Background(), pod, newTestConfig(t, tt.config), clientset, record.NewFakeRecorder(10)); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+			got := getTestPod(t, clientset, pod)
+			// Both paths remove the initializer, so the pod isn't left pending.
+			if got.Initializers != nil {
+				t.Errorf("pending initializers = %v, want none", got.Initializers.Pending)
+			}
+			if v, _ := envValue(got, "app", defaultInjectEnvName); v != tt.wantEnv {
+				t.Errorf("container app %s = %q, want %q", defaultInjectEnvName, v, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestRequestsGpu(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources corev1.ResourceRequirements
+		want      bool
+	}{
+		{
+			name: "no resources",
+		},
+		{
+			name:      "GPU limit",
+			resources: corev1.ResourceRequirements{Limits: resourceList("nvidia.com/gpu", "1")},
+			want:      true,
+		},
+		{
+			name:      "GPU request without a limit",
+			resources: corev1.ResourceRequirements{Requests: resourceList("nvidia.com/gpu", "1")},
+			want:      true,
+		},
+		{
+			name:      "zero GPU request",
+			resources: corev1.ResourceRequirements{Requests: resourceList("nvidia.com/gpu", "0")},
+		},
+		{
+			name:      "other resource request",
+			resources: corev1.ResourceRequirements{Requests: resourceList("cpu", "1")},
+		},
+	}
+
+	c := newTestConfig(t, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := newTestContainer("app")
+			container.Resources = tt.resources
+			if got := requestsGpu(container, c); got != tt.want {
+				t.Errorf("requestsGpu() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestInitializePodGpuRequestsOnly checks a container requesting a GPU only in its requests isn't injected.
+func TestInitializePodGpuRequestsOnly(t *testing.T) {
+	cuda := newTestContainer("cuda")
+	cuda.Resources.Requests = resourceList("nvidia.com/gpu", "1")
+	pod := newTestPod("requests-only", cuda, newTestContainer("app"))
+	clientset := newTestClientset(pod)
+
+	if err := initializePod(context.Background(), pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10)); err != nil {
+		t.Fatalf("initializePod() error: %v", err)
+	}
+	got := getTestPod(t, clientset, pod)
+	if _, ok := envValue(got, "cuda", defaultInjectEnvName); ok {
+		t.Errorf("container cuda has %s set", defaultInjectEnvName)
+	}
+	if v, _ := envValue(got, "app", defaultInjectEnvName); v != defaultInjectEnvValue {
+		t.Errorf("container app %s = %q, want %q", defaultInjectEnvName, v, defaultInjectEnvValue)
+	}
+}
+
+func TestNamespaceOverrides(t *testing.T) {
+	c := newTestConfig(t, `
+injectEnvValue: "global"
+namespaceOverrides:
+  research:
+    injectEnvValue: "void"
+    gpuResourceNames:
+      - "amd.com/gpu"
+  prod:
+    injectEnvValue: "prod"
+`)
+	amd := newTestContainer("rocm")
+	amd.Resources.Limits = resourceList("amd.com/gpu", "1")
+
+	tests := []struct {
+		namespace string
+		// The env value expected in each container, empty when the env must not be set.
+		wantEnv map[string]string
+	}{
+		{
+			// The override replaces the GPU resource names, nvidia.com/gpu no longer makes a GPU container.
+			namespace: "research",
+			wantEnv:   map[string]string{"app": "void", "rocm": "", "cuda": "void"},
+		},
+		{
+			namespace: "prod",
+			wantEnv:   map[string]string{"app": "prod", "rocm": "prod", "cuda": ""},
+		},
+		{
+			namespace: "default",
+			wantEnv:   map[string]string{"app": "global", "rocm": "global", "cuda": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"), amd, newGpuContainer("cuda"))
+			pod.Namespace = tt.namespace
+			got := mutateTestPod(t, c, pod)
+			for container, want := range tt.wantEnv {
+				if v, _ := envValue(got, container, defaultInjectEnvName); v != want {
+					t.Errorf("container %s %s = %q, want %q", container, defaultInjectEnvName, v, want)
+				}
+			}
+		})
+	}
+}
+
+// injectedContainers returns the names of the containers of the pod setting the inject env.
+func injectedContainers(pod *corev1.Pod) []string {
+	names := []string{}
+	for _, v := range pod.Spec.Containers {
+		if _, ok := envValue(pod, v.Name, defaultInjectEnvName); ok {
+			names = append(names, v.Name)
+		}
+	}
+	return names
+}
+
+func TestIncludeExcludeContainers(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// The containers expected to get the inject env.
+		want []string
+	}{
+		{
+			name: "injects every container by default",
+			want: []string{"app", "sidecar", "worker"},
+		},
+		{
+			name:   "skips the excluded containers",
+			config: `excludeContainers: ["sidecar"]`,
+			want:   []string{"app", "worker"},
+		},
+		{
+			name:   "only injects the included containers",
+			config: `includeContainers: ["app", "sidecar"]`,
+			want:   []string{"app", "sidecar"},
+		},
+		{
+			name: "excludes within the included containers",
+			config: `
+includeContainers: ["app", "sidecar"]
+excludeContainers: ["sidecar", "worker"]
+`,
+			want: []string{"app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"), newTestContainer("sidecar"), newTestContainer("worker"))
+			got := mutateTestPod(t, newTestConfig(t, tt.config), pod)
+			if injected := injectedContainers(got); !reflect.DeepEqual(injected, tt.want) {
+				t.Errorf("injected containers = %v, want %v", injected, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchLimiterBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		qps   rate.Limit
+		burst int
+		pods  int
+		// The shortest time the patches of all the pods can take.
+		minElapsed time.Duration
+	}{
+		{
+			name: "unlimited",
+			qps:  rate.Inf,
+			pods: 10,
+		},
+		{
+			name:  "within the burst",
+			qps:   1,
+			burst: 5,
+			pods:  5,
+		},
+		{
+			// The 3 patches past the burst wait 50ms each.
+			name:       "past the burst",
+			qps:        20,
+			burst:      2,
+			pods:       5,
+			minElapsed: 150 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &patchLimiter, rate.NewLimiter(tt.qps, tt.burst))
+			pods := []runtime.Object{}
+			for i := 0; i < tt.pods; i++ {
+				pods = append(pods, newTestPod(fmt.Sprintf("app-%d", i), newTestContainer("app")))
+			}
+			clientset := newTestClientset(pods...)
+			c := newTestConfig(t, "")
+
+			start := time.Now()
+			for _, pod := range pods {
+				if err := initializePod(context.Background(), pod.(*corev1.Pod), c, clientset, record.NewFakeRecorder(10)); err != nil {
+					t.Fatalf("initializePod() error: %v", err)
+				}
+			}
+			elapsed := time.Since(start)
+			if got := len(patchActions(clientset)); got != tt.pods {
+				t.Errorf("patches = %d, want %d", got, tt.pods)
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("the patches took %s, want at least %s", elapsed, tt.minElapsed)
+			}
+			// Without waiting the patches are done well below a second.
+			if tt.minElapsed == 0 && elapsed > time.Second {
+				t.Errorf("the patches took %s, want no wait", elapsed)
+			}
+		})
+	}
+}
+
+// TestPatchLimiterCanceled checks a patch waiting on the limiter gives up once the context is done.
+func TestPatchLimiterCanceled(t *testing.T) {
+	setFlag(t, &patchLimiter, rate.NewLimiter(rate.Every(time.Hour), 1))
+	patchLimiter.Allow()
+	pod := newTestPod("app", newTestContainer("app"))
+	clientset := newTestClientset(pod)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := initializePod(ctx, pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10)); err == nil {
+		t.Errorf("initializePod() succeeded, want the limiter wait to fail")
+	}
+	if actions := patchActions(clientset); len(actions) != 0 {
+		t.Errorf("initializePod() patched the pod past the limiter: %v", actions)
+	}
+}
+
+func TestExtraEnv(t *testing.T) {
+	c := newTestConfig(t, `
+extraEnv:
+  - name: "CUDA_VISIBLE_DEVICES"
+    value: ""
+  - name: "FOO"
+    value: "bar"
+`)
+	withEnv := func(container corev1.Container, env ...corev1.EnvVar) corev1.Container {
+		container.Env = env
+		return container
+	}
+
+	tests := []struct {
+		name      string
+		container corev1.Container
+		want      []corev1.EnvVar
+	}{
+		{
+			name:      "appends the extra env after the inject env",
+			container: newTestContainer("app"),
+			want: []corev1.EnvVar{
+				{Name: defaultInjectEnvName, Value: defaultInjectEnvValue},
+				{Name: "CUDA_VISIBLE_DEVICES", Value: ""},
+				{Name: "FOO", Value: "bar"},
+			},
+		},
+		{
+			name:      "replaces the envs of the same name",
+			container: withEnv(newTestContainer("app"), corev1.EnvVar{Name: "CUDA_VISIBLE_DEVICES", Value: "0"}, corev1.EnvVar{Name: "KEEP", Value: "1"}, corev1.EnvVar{Name: "FOO", Value: "baz"}),
+			want: []corev1.EnvVar{
+				{Name: "KEEP", Value: "1"},
+				{Name: defaultInjectEnvName, Value: defaultInjectEnvValue},
+				{Name: "CUDA_VISIBLE_DEVICES", Value: ""},
+				{Name: "FOO", Value: "bar"},
+			},
+		},
+		{
+			name:      "leaves a GPU container alone",
+			container: withEnv(newGpuContainer("cuda"), corev1.EnvVar{Name: "CUDA_VISIBLE_DEVICES", Value: "0"}),
+			want:      []corev1.EnvVar{{Name: "CUDA_VISIBLE_DEVICES", Value: "0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mutateTestPod(t, c, newTestPod("app", tt.container))
+			if env := got.Spec.Containers[0].Env; !reflect.DeepEqual(env, tt.want) {
+				t.Errorf("container env = %v, want %v", env, tt.want)
+			}
+		})
+	}
+}
+
+// TestInitializePodDeleting checks the patch of a pod being deleted only removes the initializer.
+func TestInitializePodDeleting(t *testing.T) {
+	tests := []struct {
+		name      string
+		patchType string
+		// The initializers pending after ours.
+		others []metav1.Initializer
+	}{
+		{
+			name:      "strategic merge patch",
+			patchType: patchTypeStrategic,
+		},
+		{
+			name:      "strategic merge patch keeping the other initializers",
+			patchType: patchTypeStrategic,
+			others:    []metav1.Initializer{{Name: "other.example.com"}},
+		},
+		{
+			name:      "JSON patch",
+			patchType: patchTypeJSON,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &patchType, tt.patchType)
+			pod := newTestPod("deleting", newTestContainer("app"))
+			pod.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			pod.Initializers.Pending = append(pod.Initializers.Pending, tt.others...)
+			clientset := newTestClientset(pod)
+
+			if err := initializePod(context.Background(), pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10)); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+			actions := patchActions(clientset)
+			if len(actions) != 1 {
+				t.Fatalf("patches = %d, want 1", len(actions))
+			}
+			patch := actions[0].GetPatch()
+			if tt.patchType == patchTypeJSON {
+				ops := []map[string]interface{}{}
+				if err := json.Unmarshal(patch, &ops); err != nil {
+					t.Fatal(err)
+				}
+				for _, op := range ops {
+					if path, _ := op["path"].(string); !strings.HasPrefix(path, "/metadata/") {
+						t.Errorf("the patch %s changes %s, want only the metadata", patch, path)
+					}
+				}
+			} else {
+				fields := map[string]interface{}{}
+				if err := json.Unmarshal(patch, &fields); err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := fields["metadata"]; len(fields) != 1 || !ok {
+					t.Errorf("the patch %s changes more than the metadata", patch)
+				}
+			}
+			got := getTestPod(t, clientset, pod)
+			if _, ok := envValue(got, "app", defaultInjectEnvName); ok {
+				t.Errorf("container app has %s set", defaultInjectEnvName)
+			}
+			if got.Initializers != nil && !reflect.DeepEqual(got.Initializers.Pending, tt.others) {
+				t.Errorf("pending initializers = %v, want %v", got.Initializers.Pending, tt.others)
+			}
+			if got.Initializers == nil && len(tt.others) > 0 {
+				t.Errorf("the patch removed the other initializers %v", tt.others)
+			}
+		})
+	}
+}
+
+func TestContainersAnnotation(t *testing.T) {
+	c := newTestConfig(t, `excludeContainers: ["worker"]`)
+
+	tests := []struct {
+		name string
+		// The value of the containers annotation, the pod isn't annotated when nil.
+		annotation *string
+		want       []string
+	}{
+		{
+			name: "keeps the global lists without the annotation",
+			want: []string{"app", "sidecar"},
+		},
+		{
+			name:       "overrides the global lists",
+			annotation: stringPtr("app,worker"),
+			want:       []string{"app", "worker"},
+		},
+		{
+			name:       "trims the names and ignores the empty ones",
+			annotation: stringPtr(" sidecar ,, app,"),
+			want:       []string{"app", "sidecar"},
+		},
+		{
+			name:       "ignores an empty annotation",
+			annotation: stringPtr(""),
+			want:       []string{"app", "sidecar"},
+		},
+		{
+			name:       "ignores an annotation without any name",
+			annotation: stringPtr(" , ,"),
+			want:       []string{"app", "sidecar"},
+		},
+		{
+			name:       "injects nothing when no container is listed",
+			annotation: stringPtr("missing"),
+			want:       []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"), newTestContainer("worker"), newTestContainer("sidecar"))
+			if tt.annotation != nil {
+				pod.Annotations = map[string]string{containersAnnotation: *tt.annotation}
+			}
+			got := mutateTestPod(t, c, pod)
+			if injected := injectedContainers(got); !reflect.DeepEqual(injected, tt.want) {
+				t.Errorf("injected containers = %v, want %v", injected, tt.want)
+			}
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestMatchResourcePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "*.com/gpu", name: "nvidia.com/gpu", want: true},
+		{pattern: "*.com/gpu", name: "amd.com/gpu", want: true},
+		{pattern: "*.com/gpu", name: "gpu.intel.com/i915"},
+		{pattern: "gpu.intel.com/*", name: "gpu.intel.com/i915", want: true},
+		{pattern: "gpu.intel.com/*", name: "gpu.intel.com/xe", want: true},
+		{pattern: "gpu.intel.com/*", name: "nvidia.com/gpu"},
+		{pattern: "*gpu*", name: "nvidia.com/gpu", want: true},
+		{pattern: "*gpu*", name: "gpu.intel.com/i915", want: true},
+		{pattern: "*gpu*", name: "cpu"},
+		{pattern: "nvidia.com/gpu", name: "nvidia.com/gpu", want: true},
+		{pattern: "nvidia.com/gpu", name: "nvidia.com/gpu-shared"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if got := matchResourcePattern(tt.pattern, tt.name); got != tt.want {
+				t.Errorf("matchResourcePattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGpuResourcePatterns(t *testing.T) {
+	c := newTestConfig(t, `
+gpuResourceNames: []
+gpuResourcePatterns: ["*.com/gpu", "gpu.intel.com/*"]
+`)
+	tests := []struct {
+		name      string
+		resources corev1.ResourceRequirements
+		want      bool
+	}{
+		{
+			name:      "nvidia",
+			resources: corev1.ResourceRequirements{Limits: resourceList("nvidia.com/gpu", "1")},
+			want:      true,
+		},
+		{
+			name:      "amd",
+			resources: corev1.ResourceRequirements{Limits: resourceList("amd.com/gpu", "1")},
+			want:      true,
+		},
+		{
+			name:      "intel requests only",
+			resources: corev1.ResourceRequirements{Requests: resourceList("gpu.intel.com/i915", "1")},
+			want:      true,
+		},
+		{
+			name:      "not a GPU",
+			resources: corev1.ResourceRequirements{Limits: resourceList("example.com/fpga", "1")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := newTestContainer("app")
+			container.Resources = tt.resources
+			if got := requestsGpu(container, c); got != tt.want {
+				t.Errorf("requestsGpu() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreOwnerKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		owners  []metav1.OwnerReference
+		wantEnv string
+	}{
+		{
+			name:    "injects a pod without an owner",
+			wantEnv: defaultInjectEnvValue,
+		},
+		{
+			name:    "injects a pod owned by a ReplicaSet",
+			owners:  []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app"}},
+			wantEnv: defaultInjectEnvValue,
+		},
+		{
+			name:   "skips a pod owned by a DaemonSet",
+			owners: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "nvidia-device-plugin"}},
+		},
+		{
+			name:   "skips a pod when any owner is ignored",
+			owners: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app"}, {Kind: "DaemonSet", Name: "nvidia-device-plugin"}},
+		},
+	}
+
+	c := newTestConfig(t, `ignoreOwnerKinds: ["DaemonSet"]`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.OwnerReferences = tt.owners
+			clientset := newTestClientset(pod)
+
+			if err := initializePod(context.Background(), pod, c, clientset, record.NewFakeRecorder(10)); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+			got := getTestPod(t, clientset, pod)
+			if got.Initializers != nil {
+				t.Errorf("pending initializers = %v, want none", got.Initializers.Pending)
+			}
+			if v, _ := envValue(got, "app", defaultInjectEnvName); v != tt.wantEnv {
+				t.Errorf("container app %s = %q, want %q", defaultInjectEnvName, v, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestInjectZeroGpuLimit(t *testing.T) {
+	withLimits := func(container corev1.Container, limits corev1.ResourceList) corev1.Container {
+		container.Resources.Limits = limits
+		return container
+	}
+
+	tests := []struct {
+		name       string
+		config     string
+		container  corev1.Container
+		wantLimits corev1.ResourceList
+	}{
+		{
+			name:       "sets a zero limit on a container without limits",
+			config:     "injectZeroGpuLimit: true",
+			container:  newTestContainer("app"),
+			wantLimits: resourceList("nvidia.com/gpu", "0"),
+		},
+		{
+			name:       "keeps the other limits",
+			config:     "injectZeroGpuLimit: true",
+			container:  withLimits(newTestContainer("app"), resourceList("cpu", "1")),
+			wantLimits: resourceList("cpu", "1", "nvidia.com/gpu", "0"),
+		},
+		{
+			name:       "leaves a GPU container alone",
+			config:     "injectZeroGpuLimit: true",
+			container:  newGpuContainer("cuda"),
+			wantLimits: resourceList("nvidia.com/gpu", "1"),
+		},
+		{
+			name:      "sets nothing when disabled",
+			container: newTestContainer("app"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mutateTestPod(t, newTestConfig(t, tt.config), newTestPod("app", tt.container))
+			if limits := got.Spec.Containers[0].Resources.Limits; !apiequality.Semantic.DeepEqual(limits, tt.wantLimits) {
+				t.Errorf("container limits = %v, want %v", limits, tt.wantLimits)
+			}
+		})
+	}
+}
+
+func TestGpuQuantities(t *testing.T) {
+	tests := []struct {
+		name string
+		// The nvidia.com/gpu limit, none when empty.
+		limit string
+		want  bool
+	}{
+		{name: "one GPU", limit: "1", want: true},
+		{name: "zero GPU", limit: "0"},
+		{name: "absent"},
+		{name: "fractional GPU", limit: "500m", want: true},
+		{name: "negative GPU", limit: "-1"},
+	}
+
+	c := newTestConfig(t, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := newTestContainer("app")
+			if tt.limit != "" {
+				container.Resources.Limits = resourceList("nvidia.com/gpu", tt.limit)
+			}
+			if got := requestsGpu(container, c); got != tt.want {
+				t.Errorf("requestsGpu() with limit %q = %v, want %v", tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestGpuQuantityMalformed checks a malformed quantity already fails decoding the pod, so the policy never sees it.
+func TestGpuQuantityMalformed(t *testing.T) {
+	pod := &corev1.Pod{}
+	err := json.Unmarshal([]byte(`{"spec": {"containers": [{"name": "app", "resources": {"limits": {"nvidia.com/gpu": "one"}}}]}}`), pod)
+	if err == nil {
+		t.Errorf("decoding a pod with a malformed GPU limit succeeded")
+	}
+}
+
+func TestInitializePodNothingPending(t *testing.T) {
+	tests := []struct {
+		name         string
+		initializers *metav1.Initializers
+	}{
+		{
+			name: "no initializers",
+		},
+		{
+			name:         "nil pending slice",
+			initializers: &metav1.Initializers{},
+		},
+		{
+			name:         "empty pending slice",
+			initializers: &metav1.Initializers{Pending: []metav1.Initializer{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.Initializers = tt.initializers
+			clientset := newTestClientset(pod)
+
+			if err := initializePod(context.Background(), pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10)); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+			if actions := patchActions(clientset); len(actions) != 0 {
+				t.Errorf("initializePod() patched a pod with nothing pending: %v", actions)
+			}
+		})
+	}
+}
+
+// TestInitializePodKeepsOriginalPod checks initializePod never modifies the pod it is given, which is shared
+// with the informer cache, in particular its pending initializers.
+func TestInitializePodKeepsOriginalPod(t *testing.T) {
+	other := metav1.Initializer{Name: "other.example.com"}
+	ours := metav1.Initializer{Name: defaultInitializerName}
+
+	tests := []struct {
+		name    string
+		pending []metav1.Initializer
+	}{
+		{
+			name:    "only ours",
+			pending: []metav1.Initializer{ours},
+		},
+		{
+			name:    "others after ours",
+			pending: []metav1.Initializer{ours, other, {Name: "last.example.com"}},
+		},
+		{
+			name:    "ours listed twice",
+			pending: []metav1.Initializer{ours, other, ours},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.Initializers.Pending = tt.pending
+			original := pod.DeepCopy()
+			clientset := newTestClientset(pod)
+
+			if err := initializePod(context.Background(), pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10)); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+			if len(patchActions(clientset)) != 1 {
+				t.Fatalf("initializePod() didn't patch the pod")
+			}
+			if !apiequality.Semantic.DeepEqual(pod, original) {
+				t.Errorf("initializePod() modified the original pod, pending %v, want %v", pod.Initializers.Pending, original.Initializers.Pending)
+			}
+		})
+	}
+}
+
+func TestPodSelector(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		labels      map[string]string
+		wantIgnored bool
+	}{
+		{
+			name:   "empty selector matches every pod",
+			config: "podSelector: {}",
+			labels: map[string]string{"tier": "web"},
+		},
+		{
+			name:   "matching labels",
+			config: "podSelector: {matchLabels: {tier: batch}}",
+			labels: map[string]string{"tier": "batch", "app": "etl"},
+		},
+		{
+			name:        "labels not matching",
+			config:      "podSelector: {matchLabels: {tier: batch}}",
+			labels:      map[string]string{"tier": "web"},
+			wantIgnored: true,
+		},
+		{
+			name:        "no labels",
+			config:      "podSelector: {matchLabels: {tier: batch}}",
+			wantIgnored: true,
+		},
+		{
+			name:   "matching expression",
+			config: "podSelector: {matchExpressions: [{key: tier, operator: In, values: [batch, cron]}]}",
+			labels: map[string]string{"tier": "cron"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.Labels = tt.labels
+			result, err := injectPod(context.Background(), pod, newTestConfig(t, tt.config), newTestClientset())
+			if err != nil {
+				t.Fatalf("injectPod() error: %v", err)
+			}
+			if result.ignored != tt.wantIgnored {
+				t.Errorf("injectPod() ignored the pod: %v, want %v", result.ignored, tt.wantIgnored)
+			}
+			if _, ok := envValue(pod, "app", defaultInjectEnvName); ok == tt.wantIgnored {
+				t.Errorf("container app has %s set: %v, want %v", defaultInjectEnvName, ok, !tt.wantIgnored)
+			}
+		})
+	}
+}
+
+func TestGpuContainersAnnotation(t *testing.T) {
+	tests := []struct {
+		name string
+		// The value of the gpu-containers annotation, the pod isn't annotated when nil.
+		annotation *string
+		want       []string
+	}{
+		{
+			name: "detects the GPU containers from their resources",
+			want: []string{"app", "trainer"},
+		},
+		{
+			name:       "marks a container without GPU resources as a GPU container",
+			annotation: stringPtr("trainer"),
+			want:       []string{"app"},
+		},
+		{
+			name:       "keeps the resource based detection of the other containers",
+			annotation: stringPtr("app"),
+			want:       []string{"trainer"},
+		},
+		{
+			name:       "ignores an annotation without any name",
+			annotation: stringPtr(" , "),
+			want:       []string{"app", "trainer"},
+		},
+	}
+
+	c := newTestConfig(t, "")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"), newTestContainer("trainer"), newGpuContainer("cuda"))
+			if tt.annotation != nil {
+				pod.Annotations = map[string]string{gpuContainersAnnotation: *tt.annotation}
+			}
+			got := mutateTestPod(t, c, pod)
+			if injected := injectedContainers(got); !reflect.DeepEqual(injected, tt.want) {
+				t.Errorf("injected containers = %v, want %v", injected, tt.want)
+			}
+		})
+	}
+}
+
+func TestGpuRuntimeClasses(t *testing.T) {
+	tests := []struct {
+		name         string
+		runtimeClass *string
+		wantGpuPod   bool
+	}{
+		{
+			name: "no runtime class",
+		},
+		{
+			name:         "other runtime class",
+			runtimeClass: stringPtr("runc"),
+		},
+		{
+			name:         "GPU runtime class",
+			runtimeClass: stringPtr("nvidia"),
+			wantGpuPod:   true,
+		},
+	}
+
+	c := newTestConfig(t, `gpuRuntimeClasses: ["nvidia"]`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.Spec.RuntimeClassName = tt.runtimeClass
+			result, err := injectPod(context.Background(), pod, c, newTestClientset())
+			if err != nil {
+				t.Fatalf("injectPod() error: %v", err)
+			}
+			if result.gpuPod != tt.wantGpuPod {
+				t.Errorf("injectPod() GPU pod = %v, want %v", result.gpuPod, tt.wantGpuPod)
+			}
+			if _, ok := envValue(pod, "app", defaultInjectEnvName); ok == tt.wantGpuPod {
+				t.Errorf("container app has %s set: %v, want %v", defaultInjectEnvName, ok, !tt.wantGpuPod)
+			}
+		})
+	}
+}
+
+func TestGpuSchedulerNames(t *testing.T) {
+	tests := []struct {
+		name       string
+		scheduler  string
+		wantGpuPod bool
+	}{
+		{
+			name: "scheduler not set",
+		},
+		{
+			name:      "default scheduler",
+			scheduler: corev1.DefaultSchedulerName,
+		},
+		{
+			name:       "GPU scheduler",
+			scheduler:  "gpu-scheduler",
+			wantGpuPod: true,
+		},
+	}
+
+	c := newTestConfig(t, `gpuSchedulerNames: ["gpu-scheduler"]`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.Spec.SchedulerName = tt.scheduler
+			result, err := injectPod(context.Background(), pod, c, newTestClientset())
+			if err != nil {
+				t.Fatalf("injectPod() error: %v", err)
+			}
+			if result.gpuPod != tt.wantGpuPod {
+				t.Errorf("injectPod() GPU pod = %v, want %v", result.gpuPod, tt.wantGpuPod)
+			}
+			if _, ok := envValue(pod, "app", defaultInjectEnvName); ok == tt.wantGpuPod {
+				t.Errorf("container app has %s set: %v, want %v", defaultInjectEnvName, ok, !tt.wantGpuPod)
+			}
+		})
+	}
+}
+
+func TestInitializePodNoContainers(t *testing.T) {
+	tests := []struct {
+		name           string
+		initContainers []corev1.Container
+		wantIgnored    bool
+	}{
+		{
+			name:        "no containers at all",
+			wantIgnored: true,
+		},
+		{
+			name:           "only init containers",
+			initContainers: []corev1.Container{newTestContainer("init")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("empty")
+			pod.Spec.InitContainers = tt.initContainers
+			clientset := newTestClientset(pod)
+			ignored := testutil.ToFloat64(podsIgnored)
+
+			if err := initializePod(context.Background(), pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10)); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+			actions := patchActions(clientset)
+			if len(actions) != 1 {
+				t.Fatalf("patches = %d, want 1 removing the initializer", len(actions))
+			}
+			if got := getTestPod(t, clientset, pod); got.Initializers != nil {
+				t.Errorf("pending initializers = %v, want none", got.Initializers.Pending)
+			}
+			if got := testutil.ToFloat64(podsIgnored) - ignored; (got == 1) != tt.wantIgnored {
+				t.Errorf("pods ignored increased by %v, want the pod ignored: %v", got, tt.wantIgnored)
+			}
+			if !tt.wantIgnored {
+				return
+			}
+			fields := map[string]interface{}{}
+			if err := json.Unmarshal(actions[0].GetPatch(), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fields["metadata"]; len(fields) != 1 || !ok {
+				t.Errorf("the patch %s changes more than the metadata", actions[0].GetPatch())
+			}
+		})
+	}
+}
+
+func TestGpuThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold string
+		// The nvidia.com/gpu limit of the container.
+		limit string
+		want  bool
+	}{
+		{name: "no threshold, one GPU", limit: "1", want: true},
+		{name: "no threshold, fractional GPU", limit: "500m", want: true},
+		{name: "threshold 1, one GPU", threshold: "1", limit: "1", want: true},
+		{name: "threshold 1, fractional GPU", threshold: "1", limit: "500m"},
+		{name: "threshold 1, zero GPU", threshold: "1", limit: "0"},
+		{name: "threshold 2, one GPU", threshold: "2", limit: "1"},
+		{name: "threshold 2, two GPUs", threshold: "2", limit: "2", want: true},
+		{name: "threshold 2, four GPUs", threshold: "2", limit: "4", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := ""
+			if tt.threshold != "" {
+				data = "gpuThreshold: " + tt.threshold
+			}
+			container := newTestContainer("app")
+			container.Resources.Limits = resourceList("nvidia.com/gpu", tt.limit)
+			if got := requestsGpu(container, newTestConfig(t, data)); got != tt.want {
+				t.Errorf("requestsGpu() with limit %s = %v, want %v", tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectEnvFrom(t *testing.T) {
+	shared := corev1.EnvFromSource{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "gpu-initializer-env"}}}
+	secret := corev1.EnvFromSource{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "gpu-initializer-secret"}}}
+	own := corev1.EnvFromSource{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}}}
+	c := newTestConfig(t, `
+injectEnvFrom:
+  - configMapRef: {name: "gpu-initializer-env"}
+  - secretRef: {name: "gpu-initializer-secret"}
+`)
+	withEnvFrom := func(container corev1.Container, sources ...corev1.EnvFromSource) corev1.Container {
+		container.EnvFrom = sources
+		return container
+	}
+
+	tests := []struct {
+		name      string
+		container corev1.Container
+		want      []corev1.EnvFromSource
+	}{
+		{
+			name:      "appends the sources",
+			container: newTestContainer("app"),
+			want:      []corev1.EnvFromSource{shared, secret},
+		},
+		{
+			name:      "appends after the container's own sources",
+			container: withEnvFrom(newTestContainer("app"), own),
+			want:      []corev1.EnvFromSource{own, shared, secret},
+		},
+		{
+			name:      "skips the sources already listed",
+			container: withEnvFrom(newTestContainer("app"), secret, own),
+			want:      []corev1.EnvFromSource{secret, own, shared},
+		},
+		{
+			name:      "leaves a GPU container alone",
+			container: withEnvFrom(newGpuContainer("cuda"), own),
+			want:      []corev1.EnvFromSource{own},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mutateTestPod(t, c, newTestPod("app", tt.container))
+			if envFrom := got.Spec.Containers[0].EnvFrom; !apiequality.Semantic.DeepEqual(envFrom, tt.want) {
+				t.Errorf("container envFrom = %+v, want %+v", envFrom, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveInitializer(t *testing.T) {
+	names := func(pending []metav1.Initializer) []string {
+		s := []string{}
+		for _, v := range pending {
+			s = append(s, v.Name)
+		}
+		return s
+	}
+	initializers := func(names ...string) []metav1.Initializer {
+		pending := []metav1.Initializer{}
+		for _, v := range names {
+			pending = append(pending, metav1.Initializer{Name: v})
+		}
+		return pending
+	}
+	ours := defaultInitializerName
+
+	tests := []struct {
+		name        string
+		pending     []metav1.Initializer
+		want        []string
+		wantRemoved int
+	}{
+		{
+			name:        "only ours",
+			pending:     initializers(ours),
+			want:        []string{},
+			wantRemoved: 1,
+		},
+		{
+			name:        "keeps the order of the others",
+			pending:     initializers(ours, "a.example.com", "b.example.com"),
+			want:        []string{"a.example.com", "b.example.com"},
+			wantRemoved: 1,
+		},
+		{
+			name:        "removes a duplicate after the others",
+			pending:     initializers(ours, "a.example.com", ours),
+			want:        []string{"a.example.com"},
+			wantRemoved: 2,
+		},
+		{
+			name:        "removes adjacent duplicates",
+			pending:     initializers(ours, ours, "a.example.com"),
+			want:        []string{"a.example.com"},
+			wantRemoved: 2,
+		},
+		{
+			name:    "nothing to remove",
+			pending: initializers("a.example.com"),
+			want:    []string{"a.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, removed := removeInitializer(tt.pending, ours)
+			if !reflect.DeepEqual(names(got), tt.want) || removed != tt.wantRemoved {
+				t.Errorf("removeInitializer(%v) = %v, %d, want %v, %d", names(tt.pending), names(got), removed, tt.want, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+// TestInitializePodDuplicateInitializer checks a pod listing our initializer twice is initialized once and not left pending on us.
+func TestInitializePodDuplicateInitializer(t *testing.T) {
+	pod := newTestPod("app", newTestContainer("app"))
+	pod.Initializers.Pending = []metav1.Initializer{{Name: defaultInitializerName}, {Name: "other.example.com"}, {Name: defaultInitializerName}}
+	clientset := newTestClientset(pod)
+
+	if err := initializePod(context.Background(), pod, newTestConfig(t, ""), clientset, record.NewFakeRecorder(10)); err != nil {
+		t.Fatalf("initializePod() error: %v", err)
+	}
+	got := getTestPod(t, clientset, pod)
+	if want := []metav1.Initializer{{Name: "other.example.com"}}; got.Initializers == nil || !reflect.DeepEqual(got.Initializers.Pending, want) {
+		t.Errorf("pending initializers = %+v, want %v", got.Initializers, want)
+	}
+}
+
+func TestPatchSubresource(t *testing.T) {
+	deleting := newTestPod("deleting", newTestContainer("app"))
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		// Patch the subresource with applyNewPod rather than initializing the pod.
+		subresource *string
+		want        string
+	}{
+		{
+			name: "initializePod patches the pod resource",
+			pod:  newTestPod("app", newTestContainer("app")),
+			want: podResource,
+		},
+		{
+			name: "initializePod patches the pod resource of a pod being deleted",
+			pod:  deleting,
+			want: podResource,
+		},
+		{
+			name:        "applyNewPod patches the given subresource",
+			pod:         newTestPod("app", newTestContainer("app")),
+			subresource: stringPtr("status"),
+			want:        "status",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := newTestClientset(tt.pod)
+			c := newTestConfig(t, "")
+			var err error
+			if tt.subresource != nil {
+				newPod := tt.pod.DeepCopy()
+				newPod.Status.Message = "patched"
+				err = applyNewPod(context.Background(), tt.pod, newPod, c, clientset, *tt.subresource)
+			} else {
+				err = initializePod(context.Background(), tt.pod, c, clientset, record.NewFakeRecorder(10))
+			}
+			if err != nil {
+				t.Fatalf("patching the pod: %v", err)
+			}
+			actions := patchActions(clientset)
+			if len(actions) != 1 {
+				t.Fatalf("patches = %d, want 1", len(actions))
+			}
+			if got := actions[0].GetResource().Resource; got != "pods" {
+				t.Errorf("patched resource = %q, want pods", got)
+			}
+			if got := actions[0].GetSubresource(); got != tt.want {
+				t.Errorf("patched subresource = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripOverhead(t *testing.T) {
+	tests := []struct {
+		name  string
+		pt    types.PatchType
+		patch string
+		want  string
+	}{
+		{
+			name:  "JSON patch without the overhead",
+			pt:    types.JSONPatchType,
+			patch: `[{"op":"remove","path":"/metadata/initializers"}]`,
+			want:  `[{"op":"remove","path":"/metadata/initializers"}]`,
+		},
+		{
+			name:  "JSON patch of the overhead",
+			pt:    types.JSONPatchType,
+			patch: `[{"op":"add","path":"/spec/overhead","value":{"cpu":"1"}},{"op":"replace","path":"/spec/overhead/memory","value":"1Gi"},{"op":"remove","path":"/metadata/initializers"}]`,
+			want:  `[{"op":"remove","path":"/metadata/initializers"}]`,
+		},
+		{
+			name:  "JSON patch of a field starting like the overhead",
+			pt:    types.JSONPatchType,
+			patch: `[{"op":"add","path":"/spec/overheadExtra","value":1}]`,
+			want:  `[{"op":"add","path":"/spec/overheadExtra","value":1}]`,
+		},
+		{
+			name:  "strategic merge patch without a spec",
+			pt:    types.StrategicMergePatchType,
+			patch: `{"metadata":{"initializers":null}}`,
+			want:  `{"metadata":{"initializers":null}}`,
+		},
+		{
+			name:  "strategic merge patch of the overhead only",
+			pt:    types.StrategicMergePatchType,
+			patch: `{"metadata":{"initializers":null},"spec":{"overhead":{"cpu":"1"}}}`,
+			want:  `{"metadata":{"initializers":null}}`,
+		},
+		{
+			name:  "strategic merge patch of the overhead and the containers",
+			pt:    types.StrategicMergePatchType,
+			patch: `{"spec":{"containers":[{"name":"app"}],"overhead":null}}`,
+			want:  `{"spec":{"containers":[{"name":"app"}]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stripOverhead(tt.pt, []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("stripOverhead() error: %v", err)
+			}
+			var gotValue, wantValue interface{}
+			if err := json.Unmarshal(got, &gotValue); err != nil {
+				t.Fatalf("stripOverhead() returned invalid JSON %s: %v", got, err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("stripOverhead() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCreatePatchOverhead checks the injection patches never touch spec.overhead.
+func TestCreatePatchOverhead(t *testing.T) {
+	c := newTestConfig(t, "")
+	pod := newTestPod("app", newTestContainer("app"), newGpuContainer("cuda"))
+	for _, pt := range []string{patchTypeStrategic, patchTypeJSON} {
+		t.Run(pt, func(t *testing.T) {
+			_, patch, err := createPatch(pod, mutateTestPod(t, c, pod), pt, c.PreserveOverhead)
+			if err != nil {
+				t.Fatalf("createPatch() error: %v", err)
+			}
+			if bytes.Contains(patch, []byte("overhead")) {
+				t.Errorf("createPatch() = %s, touches the overhead", patch)
+			}
+		})
+	}
+}
+
+func TestSkipMirrorPods(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		annotations map[string]string
+		wantEnv     string
+	}{
+		{
+			name:    "injects a pod that is not a mirror pod",
+			wantEnv: defaultInjectEnvValue,
+		},
+		{
+			name:        "skips a mirror pod",
+			annotations: map[string]string{mirrorPodAnnotation: "0123456789abcdef"},
+		},
+		{
+			name:        "skips a mirror pod without annotating it",
+			config:      "skipReasonAnnotations: true",
+			annotations: map[string]string{mirrorPodAnnotation: "0123456789abcdef"},
+		},
+		{
+			name:        "injects a mirror pod when not skipped",
+			config:      "skipMirrorPods: false",
+			annotations: map[string]string{mirrorPodAnnotation: "0123456789abcdef"},
+			wantEnv:     defaultInjectEnvValue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("static", newTestContainer("app"))
+			pod.Annotations = tt.annotations
+			clientset := newTestClientset(pod)
+
+			if err := initializePod(context.Background(), pod, newTestConfig(t, tt.config), clientset, record.NewFakeRecorder(10)); err != nil {
+				t.Fatalf("initializePod() error: %v", err)
+			}
+			got := getTestPod(t, clientset, pod)
+			if got.Initializers != nil {
+				t.Errorf("pending initializers = %v, want none", got.Initializers.Pending)
+			}
+			if v, _ := envValue(got, "app", defaultInjectEnvName); v != tt.wantEnv {
+				t.Errorf("container app %s = %q, want %q", defaultInjectEnvName, v, tt.wantEnv)
+			}
+			if v, ok := got.Annotations[skipReasonAnnotation]; ok {
+				t.Errorf("the pod is annotated with the skip reason %q", v)
+			}
+		})
+	}
+}
+
+// TestReadmeSampleConfig checks the sample config of the README is a valid config, so the documentation
+// doesn't drift from the schema.
+func TestReadmeSampleConfig(t *testing.T) {
+	readme, err := ioutil.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, section, ok := bytes.Cut(readme, []byte("\n## Configuration\n"))
+	if !ok {
+		t.Fatal("README.md has no Configuration section")
+	}
+	_, sample, ok := bytes.Cut(section, []byte("\n```\n"))
+	if !ok {
+		t.Fatal("the Configuration section of README.md has no sample config")
+	}
+	sample, _, ok = bytes.Cut(sample, []byte("\n```"))
+	if !ok {
+		t.Fatal("the sample config of README.md isn't terminated")
+	}
+
+	c, err := parseConfig(sample)
+	if err != nil {
+		t.Fatalf("parseConfig() of the README sample config error: %v", err)
+	}
+	if len(c.NamespaceOverrides) == 0 || len(c.InjectEnvs) == 0 {
+		t.Errorf("parseConfig() of the README sample config dropped fields: %+v", c)
+	}
+}
+
+func TestIgnoreManagedBy(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		wantIgnored bool
+	}{
+		{
+			name: "no labels",
+		},
+		{
+			name:   "label absent",
+			labels: map[string]string{"app": "web"},
+		},
+		{
+			name:   "managed by another component",
+			labels: map[string]string{managedByLabel: "Helm"},
+		},
+		{
+			name:        "managed by an ignored component",
+			labels:      map[string]string{managedByLabel: "gpu-operator"},
+			wantIgnored: true,
+		},
+	}
+
+	c := newTestConfig(t, `ignoreManagedBy: ["gpu-operator"]`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newTestPod("app", newTestContainer("app"))
+			pod.Labels = tt.labels
+			result, err := injectPod(context.Background(), pod, c, newTestClientset())
+			if err != nil {
+				t.Fatalf("injectPod() error: %v", err)
+			}
+			if result.ignored != tt.wantIgnored {
+				t.Errorf("injectPod() ignored the pod: %v, want %v", result.ignored, tt.wantIgnored)
+			}
+			if _, ok := envValue(pod, "app", defaultInjectEnvName); ok == tt.wantIgnored {
+				t.Errorf("container app has %s set: %v, want %v", defaultInjectEnvName, ok, !tt.wantIgnored)
+			}
+		})
+	}
+}
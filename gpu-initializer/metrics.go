@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	podsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_pods_processed_total",
+		Help: "Number of pods this initializer has processed.",
+	})
+	podsInjected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_pods_injected_total",
+		Help: "Number of pods the inject env was injected into.",
+	})
+	podsIgnored = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_pods_ignored_total",
+		Help: "Number of pods left untouched for one of the skip reasons, e.g. their namespace, owner, labels, annotations or GPU runtime class. The skip-reason annotation codes list them all.",
+	})
+	patchErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_patch_errors_total",
+		Help: "Number of failed pod patches.",
+	})
+	injectionsByNamespace = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gpu_initializer_injections_by_namespace",
+		Help: "Number of pods the inject env was injected into, by namespace.",
+	}, []string{"namespace"})
+	configErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_config_errors_total",
+		Help: "Number of times the config failed to load.",
+	})
+	reconcileDrift = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_reconcile_drift_total",
+		Help: "Number of initialized pods found not matching the injection policy with -reconcile-initialized.",
+	})
+	throttled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_throttled_total",
+		Help: "Number of pod patches the API server rejected with 429 Too Many Requests.",
+	})
+	auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_audit_dropped_total",
+		Help: "Number of audit log entries dropped because the writer fell behind.",
+	})
+	processingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gpu_initializer_processing_duration_seconds",
+		Help:    "Time from picking up a pod to its successful patch.",
+		Buckets: prometheus.DefBuckets,
+	})
+	initializationDelay = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gpu_initializer_initialization_delay_seconds",
+		Help:    "Time from the creation of a pod to its successful patch, including the wait for the initializers before this one.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	largePatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_large_patch_total",
+		Help: "Number of pod patches larger than -large-patch-bytes.",
+	})
+	// Like podsInjected and podsIgnored, these two are only counted once the pod was patched.
+	alreadyCompliant = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_already_compliant_total",
+		Help: "Number of pods that were not ignored and needed no change.",
+	})
+	driftFixed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gpu_initializer_drift_fixed_total",
+		Help: "Number of pods that were not ignored and needed a change.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(podsProcessed, podsInjected, podsIgnored, patchErrors, injectionsByNamespace, alreadyCompliant, driftFixed, largePatches, configErrors, reconcileDrift, throttled, auditDropped, processingDuration, initializationDelay)
+}
+
+// countInjection counts an injected pod. The namespace label is left empty with -namespace-metrics=false,
+// keeping a single series on clusters with many namespaces.
+func countInjection(namespace string) {
+	podsInjected.Inc()
+	if !namespaceMetrics {
+		namespace = ""
+	}
+	injectionsByNamespace.WithLabelValues(namespace).Inc()
+}
+
+// observeInitialized records the latencies of a pod patched after being picked up at start.
+func observeInitialized(pod *corev1.Pod, start time.Time) {
+	now := time.Now()
+	processingDuration.Observe(now.Sub(start).Seconds())
+	if !pod.CreationTimestamp.IsZero() {
+		initializationDelay.Observe(now.Sub(pod.CreationTimestamp.Time).Seconds())
+	}
+}
+
+// serveMetrics serves the Prometheus metrics on addr.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	slog.Info("Serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fatal("Serving metrics", "addr", addr, "error", err)
+	}
+}
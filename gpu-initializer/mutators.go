@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Mutator is one step of the injection, applied to the pods the policy applies to.
+type Mutator interface {
+	// Name identifies the mutator in errors.
+	Name() string
+	// Apply returns the mutated pod. The pod is a copy owned by the caller, so it may be changed in place.
+	// The config is the one for the pod, see forPod.
+	Apply(pod *corev1.Pod, c *config) (*corev1.Pod, error)
+}
+
+// mutators are the enabled mutators, applied in order. Each one leaves the pod alone when the config
+// doesn't ask for its change. The order matters, maskVolumeMutator adds the volume envMutator mounted.
+var mutators = []Mutator{
+	envMutator{},
+	maskVolumeMutator{},
+	schedulingMutator{},
+	initContainerMutator{},
+}
+
+// applyMutators returns a copy of the pod with the mutators applied in order.
+func applyMutators(pod *corev1.Pod, c *config, mutators []Mutator) (*corev1.Pod, error) {
+	mutatedPod := pod.DeepCopy()
+	for _, m := range mutators {
+		var err error
+		mutatedPod, err = m.Apply(mutatedPod, c)
+		if err != nil {
+			return nil, fmt.Errorf("mutator %s: %w", m.Name(), err)
+		}
+	}
+	return mutatedPod, nil
+}
+
+// envMutator injects the envs into the containers, and the init containers with IncludeInitContainers, see injectEnv.
+type envMutator struct{}
+
+func (envMutator) Name() string {
+	return "env"
+}
+
+func (envMutator) Apply(pod *corev1.Pod, c *config) (*corev1.Pod, error) {
+	injectEnv(pod.Spec.Containers, c)
+	if c.IncludeInitContainers {
+		// InjectInitContainer is prepended after this mutator and kept as configured. Leave it alone when
+		// the pod already has it, otherwise reconciling an injected pod would report it as drifted.
+		ic := c
+		if c.InjectInitContainer != nil {
+			nc := *c
+			nc.ExcludeContainers = append(append([]string{}, c.ExcludeContainers...), c.InjectInitContainer.Name)
+			ic = &nc
+		}
+		injectEnv(pod.Spec.InitContainers, ic)
+	}
+	return pod, nil
+}
+
+// maskVolumeMutator adds the volume mounted at MaskDevicePath by envMutator.
+type maskVolumeMutator struct{}
+
+func (maskVolumeMutator) Name() string {
+	return "mask-volume"
+}
+
+func (maskVolumeMutator) Apply(pod *corev1.Pod, c *config) (*corev1.Pod, error) {
+	if c.MaskDevicePath != "" {
+		addMaskVolume(pod, c)
+	}
+	return pod, nil
+}
+
+// schedulingMutator merges InjectTolerations and InjectNodeAffinity into pods that don't use a GPU at all.
+type schedulingMutator struct{}
+
+func (schedulingMutator) Name() string {
+	return "scheduling"
+}
+
+func (schedulingMutator) Apply(pod *corev1.Pod, c *config) (*corev1.Pod, error) {
+	if isGpuPod(pod, c) {
+		return pod, nil
+	}
+	pod.Spec.Tolerations = mergeTolerations(pod.Spec.Tolerations, c.InjectTolerations)
+	if c.InjectNodeAffinity != nil {
+		if pod.Spec.Affinity == nil {
+			pod.Spec.Affinity = &corev1.Affinity{}
+		}
+		pod.Spec.Affinity.NodeAffinity = mergeNodeAffinity(pod.Spec.Affinity.NodeAffinity, c.InjectNodeAffinity)
+	}
+	return pod, nil
+}
+
+// initContainerMutator prepends InjectInitContainer to pods that don't use a GPU at all,
+// unless they already have an init container of the same name.
+type initContainerMutator struct{}
+
+func (initContainerMutator) Name() string {
+	return "init-container"
+}
+
+func (initContainerMutator) Apply(pod *corev1.Pod, c *config) (*corev1.Pod, error) {
+	if c.InjectInitContainer == nil || isGpuPod(pod, c) || hasContainer(pod.Spec.InitContainers, c.InjectInitContainer.Name) {
+		return pod, nil
+	}
+	pod.Spec.InitContainers = append([]corev1.Container{*c.InjectInitContainer.DeepCopy()}, pod.Spec.InitContainers...)
+	return pod, nil
+}
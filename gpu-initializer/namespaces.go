@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+)
+
+const namespaceCacheTTL = time.Minute
+
+// namespaceLabelCache caches namespace labels, so the ignore selector doesn't cost an API call per pod.
+var namespaceLabelCache = utilcache.NewLRUExpireCache(1024)
+
+// isIgnoredNamespace reports whether pods in the namespace are left untouched, because it is not listed
+// in a non-empty OnlyNamespaces, it is listed in IgnoreNamespaces, matches one of IgnoreNamespaceRegexes
+// or its labels match the IgnoreNamespaceSelector.
+func isIgnoredNamespace(ctx context.Context, namespace string, c *config, clientset kubernetes.Interface) (bool, error) {
+	if len(c.OnlyNamespaces) > 0 && !containsString(c.OnlyNamespaces, namespace) {
+		return true, nil
+	}
+	for _, v := range c.IgnoreNamespaces {
+		if v == namespace {
+			return true, nil
+		}
+	}
+	for _, re := range c.ignoreNamespaceRegexes {
+		if re.MatchString(namespace) {
+			return true, nil
+		}
+	}
+
+	if c.ignoreNamespaceSelector == nil {
+		return false, nil
+	}
+	nsLabels, err := getNamespaceLabels(ctx, clientset, namespace)
+	if err != nil {
+		return false, err
+	}
+	return c.ignoreNamespaceSelector.Matches(labels.Set(nsLabels)), nil
+}
+
+// getNamespaceLabels returns the labels of the namespace, fetching them from the API server on a cache miss.
+func getNamespaceLabels(ctx context.Context, clientset kubernetes.Interface, name string) (map[string]string, error) {
+	if v, ok := namespaceLabelCache.Get(name); ok {
+		return v.(map[string]string), nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ns, err := clientset.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	namespaceLabelCache.Add(name, ns.Labels, namespaceCacheTTL)
+	return ns.Labels, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestIgnoreNamespaceRegexes(t *testing.T) {
+	c := newTestConfig(t, `ignoreNamespaceRegexes: ["^kube-"]`)
+
+	tests := []struct {
+		namespace string
+		want      bool
+	}{
+		{namespace: "kube-public", want: true},
+		{namespace: "kube-node-lease", want: true},
+		{namespace: "kube-dynamic-1a2b", want: true},
+		{namespace: "default"},
+		{namespace: "my-kube-apps"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			got, err := isIgnoredNamespace(context.Background(), tt.namespace, c, newTestClientset())
+			if err != nil {
+				t.Fatalf("isIgnoredNamespace() error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("isIgnoredNamespace(%q) = %v, want %v", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreNamespaceRegexesInvalid(t *testing.T) {
+	_, err := parseConfig([]byte(`ignoreNamespaceRegexes: ["^kube-", "(unclosed"]`))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Field != "ignoreNamespaceRegexes[1]" {
+		t.Errorf("parseConfig() error = %v, want a ValidationError of ignoreNamespaceRegexes[1]", err)
+	}
+}
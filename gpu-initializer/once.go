@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+// runOnce initializes the currently uninitialized pods of the watched namespaces a single time, without an informer.
+// It returns the number of pods processed, the ones pending on this initializer, and the number of pods that failed.
+func runOnce(ctx context.Context, clientset kubernetes.Interface, c *config, recorder record.EventRecorder) (int, int, error) {
+	processed, failed := 0, 0
+	for _, ns := range watchNamespaceList() {
+		pods, err := listUninitializedPods(ctx, clientset, ns)
+		if err != nil {
+			return processed, failed, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			// The list includes the initialized pods and those pending on other initializers first.
+			if !isPendingOn(pod, initializerName) {
+				continue
+			}
+			processed++
+			if err := initializePod(ctx, pod, c, clientset, recorder); err != nil {
+				slog.Error("Initializing pod failed", "pod", pod.Name, "namespace", pod.Namespace, "error", err)
+				failed++
+			}
+		}
+	}
+	return processed, failed, nil
+}
+
+// listUninitializedPods lists the pods of the namespace, uninitialized ones included.
+func listUninitializedPods(ctx context.Context, clientset kubernetes.Interface, namespace string) (*corev1.PodList, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{IncludeUninitialized: true})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRunOnce(t *testing.T) {
+	pending := newTestPod("pending", newTestContainer("app"))
+	waiting := newTestPod("waiting", newTestContainer("app"))
+	waiting.Initializers.Pending = []metav1.Initializer{{Name: "other.example.com"}, {Name: defaultInitializerName}}
+	initialized := newTestPod("initialized", newTestContainer("app"))
+	initialized.Initializers = nil
+	failing := newTestPod("failing", newTestContainer("app"))
+
+	tests := []struct {
+		name          string
+		objects       []runtime.Object
+		wantProcessed int
+		wantFailed    int
+	}{
+		{
+			name:          "only counts the pods pending on the initializer",
+			objects:       []runtime.Object{pending, waiting, initialized},
+			wantProcessed: 1,
+		},
+		{
+			name:          "counts the failed pods",
+			objects:       []runtime.Object{pending, failing},
+			wantProcessed: 2,
+			wantFailed:    1,
+		},
+		{
+			name: "no pods",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := newTestClientset(tt.objects...)
+			clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.(k8stesting.PatchAction).GetName() != failing.Name {
+					return false, nil, nil
+				}
+				return true, nil, apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, failing.Name, nil)
+			})
+
+			processed, failed, err := runOnce(context.Background(), clientset, newTestConfig(t, ""), record.NewFakeRecorder(10))
+			if err != nil {
+				t.Fatalf("runOnce() error: %v", err)
+			}
+			if processed != tt.wantProcessed || failed != tt.wantFailed {
+				t.Errorf("runOnce() = %d processed, %d failed, want %d processed, %d failed", processed, failed, tt.wantProcessed, tt.wantFailed)
+			}
+		})
+	}
+}
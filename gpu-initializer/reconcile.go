@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+)
+
+const reconciledPodTTL = time.Hour
+
+// reconciledPods remembers the pod versions already checked, so each resync doesn't check and report them again.
+var reconciledPods = utilcache.NewLRUExpireCache(4096)
+
+// reconcilePod checks that an initialized pod still matches the injection policy, for -reconcile-initialized.
+// The API server rejects changes to the env of an initialized pod, so a drifted pod is reported with a
+// warning event and the reconcile drift metric instead of being patched, which would fail on every resync.
+func reconcilePod(ctx context.Context, pod *corev1.Pod, c *config, clientset kubernetes.Interface, recorder record.EventRecorder) error {
+	if pod.ObjectMeta.DeletionTimestamp != nil {
+		return nil
+	}
+	key := string(pod.UID) + "/" + pod.ResourceVersion
+	if _, ok := reconciledPods.Get(key); ok {
+		return nil
+	}
+
+	c = c.forNamespace(pod.Namespace).forPod(pod)
+	s, err := skipReason(ctx, pod, c, clientset)
+	if err != nil {
+		return err
+	}
+	reconciledPods.Add(key, struct{}{}, reconciledPodTTL)
+	if s != nil {
+		return nil
+	}
+
+	mutatedPod, err := mutatePodSpec(pod, c)
+	if err != nil {
+		return err
+	}
+	if apiequality.Semantic.DeepEqual(pod.Spec, mutatedPod.Spec) {
+		return nil
+	}
+	containers := changedContainers(pod, mutatedPod)
+	slog.Warn("Initialized pod does not match the injection policy", "pod", pod.Name, "namespace", pod.Namespace, "action", "drifted", "containers", containers)
+	reconcileDrift.Inc()
+	if !dryRun {
+		recorder.Event(pod, corev1.EventTypeWarning, "Drifted", "Pod spec does not match the injection policy")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReconcilePod(t *testing.T) {
+	c := newTestConfig(t, `
+injectNodeAffinity:
+  preferredDuringSchedulingIgnoredDuringExecution:
+    - weight: 100
+      preference:
+        matchExpressions: [{key: "gpu", operator: "DoesNotExist"}]
+`)
+	injected := mutateTestPod(t, c, newTestPod("injected", newTestContainer("app")))
+	injected.Initializers = nil
+	// A pod-level change only, no container drifted.
+	drifted := injected.DeepCopy()
+	drifted.Name = "drifted"
+	drifted.Spec.Affinity = nil
+
+	tests := []struct {
+		name      string
+		pod       *corev1.Pod
+		wantEvent string
+	}{
+		{
+			name: "injected pod",
+			pod:  injected,
+		},
+		{
+			name:      "pod drifted from the policy",
+			pod:       drifted,
+			wantEvent: "Warning Drifted Pod spec does not match the injection policy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := tt.pod.DeepCopy()
+			pod.UID = types.UID(t.Name())
+			recorder := record.NewFakeRecorder(10)
+
+			if err := reconcilePod(context.Background(), pod, c, newTestClientset(), recorder); err != nil {
+				t.Fatalf("reconcilePod() error: %v", err)
+			}
+			event := ""
+			if len(recorder.Events) > 0 {
+				event = <-recorder.Events
+			}
+			if event != tt.wantEvent {
+				t.Errorf("reconcilePod() event = %q, want %q", event, tt.wantEvent)
+			}
+		})
+	}
+}
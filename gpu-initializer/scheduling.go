@@ -0,0 +1,134 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+)
+
+// mergeTolerations appends the tolerations that don't match one of the existing tolerations.
+func mergeTolerations(existing, tolerations []corev1.Toleration) []corev1.Toleration {
+	merged := existing
+	for i := range tolerations {
+		found := false
+		for j := range merged {
+			if merged[j].MatchToleration(&tolerations[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, tolerations[i])
+		}
+	}
+	return merged
+}
+
+// mergeNodeAffinity merges the injected node affinity into the one the pod declares, keeping the pod's.
+// Required terms are ANDed with the pod's required terms, preferred terms are appended. Merging an already
+// merged affinity again leaves it unchanged, so reconciling an injected pod doesn't report it as drifted.
+func mergeNodeAffinity(existing, inject *corev1.NodeAffinity) *corev1.NodeAffinity {
+	inject = inject.DeepCopy()
+	if existing == nil {
+		return inject
+	}
+
+	merged := existing.DeepCopy()
+	if required := inject.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+		if merged.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+			merged.RequiredDuringSchedulingIgnoredDuringExecution = required
+		} else {
+			merged.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = andNodeSelectorTerms(
+				merged.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, required.NodeSelectorTerms)
+		}
+	}
+	for _, term := range inject.PreferredDuringSchedulingIgnoredDuringExecution {
+		if !hasPreferredTerm(merged.PreferredDuringSchedulingIgnoredDuringExecution, term) {
+			merged.PreferredDuringSchedulingIgnoredDuringExecution = append(merged.PreferredDuringSchedulingIgnoredDuringExecution, term)
+		}
+	}
+	return merged
+}
+
+// andNodeSelectorTerms returns the terms selecting the nodes that match a term of a and a term of b.
+// Terms are ORed, so this is the cross product of both lists with the requirements of each pair combined.
+// A term of a already including all the requirements of a term of b is kept as is: it selects a subset of
+// the nodes of that term, and the combinations with the other terms of b only select subsets of it.
+func andNodeSelectorTerms(a, b []corev1.NodeSelectorTerm) []corev1.NodeSelectorTerm {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+
+	terms := []corev1.NodeSelectorTerm{}
+	add := func(term corev1.NodeSelectorTerm) {
+		for _, t := range terms {
+			if apiequality.Semantic.DeepEqual(t, term) {
+				return
+			}
+		}
+		terms = append(terms, term)
+	}
+	for _, x := range a {
+		if includesAnyTerm(x, b) {
+			add(x)
+			continue
+		}
+		for _, y := range b {
+			term := *x.DeepCopy()
+			term.MatchExpressions = appendRequirements(term.MatchExpressions, y.MatchExpressions)
+			term.MatchFields = appendRequirements(term.MatchFields, y.MatchFields)
+			add(term)
+		}
+	}
+	return terms
+}
+
+// includesAnyTerm reports whether the term has all the requirements of one of the terms.
+func includesAnyTerm(term corev1.NodeSelectorTerm, terms []corev1.NodeSelectorTerm) bool {
+	for _, t := range terms {
+		if includesRequirements(term.MatchExpressions, t.MatchExpressions) && includesRequirements(term.MatchFields, t.MatchFields) {
+			return true
+		}
+	}
+	return false
+}
+
+// includesRequirements reports whether all the requirements are in the existing ones.
+func includesRequirements(existing, requirements []corev1.NodeSelectorRequirement) bool {
+	for _, r := range requirements {
+		if !hasRequirement(existing, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendRequirements appends the requirements not already in the existing ones.
+func appendRequirements(existing, requirements []corev1.NodeSelectorRequirement) []corev1.NodeSelectorRequirement {
+	for _, r := range requirements {
+		if !hasRequirement(existing, r) {
+			existing = append(existing, r)
+		}
+	}
+	return existing
+}
+
+func hasRequirement(requirements []corev1.NodeSelectorRequirement, r corev1.NodeSelectorRequirement) bool {
+	for _, v := range requirements {
+		if apiequality.Semantic.DeepEqual(v, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPreferredTerm(terms []corev1.PreferredSchedulingTerm, term corev1.PreferredSchedulingTerm) bool {
+	for _, v := range terms {
+		if apiequality.Semantic.DeepEqual(v, term) {
+			return true
+		}
+	}
+	return false
+}
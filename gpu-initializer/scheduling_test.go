@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+)
+
+func TestMergeNodeAffinityIdempotent(t *testing.T) {
+	requirement := func(key string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: key, Operator: corev1.NodeSelectorOpDoesNotExist}
+	}
+	term := func(keys ...string) corev1.NodeSelectorTerm {
+		term := corev1.NodeSelectorTerm{}
+		for _, key := range keys {
+			term.MatchExpressions = append(term.MatchExpressions, requirement(key))
+		}
+		return term
+	}
+	required := func(terms ...corev1.NodeSelectorTerm) *corev1.NodeSelector {
+		return &corev1.NodeSelector{NodeSelectorTerms: terms}
+	}
+	preferred := []corev1.PreferredSchedulingTerm{{Weight: 100, Preference: term("gpu")}}
+
+	tests := []struct {
+		name     string
+		existing *corev1.NodeAffinity
+		inject   *corev1.NodeAffinity
+		want     *corev1.NodeAffinity
+	}{
+		{
+			name:   "no node affinity",
+			inject: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("gpu")), PreferredDuringSchedulingIgnoredDuringExecution: preferred},
+			want:   &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("gpu")), PreferredDuringSchedulingIgnoredDuringExecution: preferred},
+		},
+		{
+			name:     "appends the preferred terms",
+			existing: &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{Weight: 1, Preference: term("zone")}}},
+			inject:   &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: preferred},
+			want: &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+				{Weight: 1, Preference: term("zone")},
+				{Weight: 100, Preference: term("gpu")},
+			}},
+		},
+		{
+			name:     "ANDs the required terms",
+			existing: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("zone"), term("rack"))},
+			inject:   &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("gpu"))},
+			want:     &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("zone", "gpu"), term("rack", "gpu"))},
+		},
+		{
+			name:     "ANDs several injected required terms",
+			existing: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("zone"))},
+			inject:   &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("gpu"), term("tpu"))},
+			want:     &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: required(term("zone", "gpu"), term("zone", "tpu"))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeNodeAffinity(tt.existing, tt.inject)
+			if !apiequality.Semantic.DeepEqual(got, tt.want) {
+				t.Fatalf("mergeNodeAffinity() = %+v, want %+v", got, tt.want)
+			}
+			if again := mergeNodeAffinity(got, tt.inject); !apiequality.Semantic.DeepEqual(again, got) {
+				t.Errorf("merging again = %+v, want it unchanged %+v", again, got)
+			}
+		})
+	}
+}
+
+// TestMutatePodSpecIdempotent checks mutating an injected pod again leaves its spec unchanged, as reconciling does.
+func TestMutatePodSpecIdempotent(t *testing.T) {
+	c := newTestConfig(t, `
+injectTolerations:
+  - {key: "gpu", operator: "Exists", effect: "NoSchedule"}
+injectNodeAffinity:
+  requiredDuringSchedulingIgnoredDuringExecution:
+    nodeSelectorTerms:
+      - matchExpressions: [{key: "gpu", operator: "DoesNotExist"}]
+      - matchExpressions: [{key: "tpu", operator: "DoesNotExist"}]
+  preferredDuringSchedulingIgnoredDuringExecution:
+    - weight: 100
+      preference:
+        matchExpressions: [{key: "accelerator", operator: "DoesNotExist"}]
+injectSecurityContext: {capabilities: {drop: ["SYS_ADMIN"]}}
+injectInitContainer: {name: "gpu-cleanup", image: "registry.example.com/gpu-cleanup:1.0"}
+extraEnv:
+  - {name: "CUDA_VISIBLE_DEVICES", value: ""}
+injectZeroGpuLimit: true
+maskDevicePath: "/dev/nvidia"
+`)
+	pod := newTestPod("app", newTestContainer("app"))
+	pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+			{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}}},
+		}},
+	}}
+
+	once := mutateTestPod(t, c, pod)
+	twice := mutateTestPod(t, c, once)
+	if !apiequality.Semantic.DeepEqual(once.Spec, twice.Spec) {
+		t.Errorf("mutating the injected pod again changed it from %+v to %+v", once.Spec, twice.Spec)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mergeSecurityContext merges the injected security context into the one the container declares, keeping the
+// container's. Each field is only taken from the injected context when the container leaves it unset, the
+// capabilities to add and to drop each count as a field of their own.
+func mergeSecurityContext(existing, inject *corev1.SecurityContext) *corev1.SecurityContext {
+	inject = inject.DeepCopy()
+	if existing == nil {
+		return inject
+	}
+
+	merged := existing.DeepCopy()
+	if merged.Capabilities == nil {
+		merged.Capabilities = inject.Capabilities
+	} else if inject.Capabilities != nil {
+		if merged.Capabilities.Add == nil {
+			merged.Capabilities.Add = inject.Capabilities.Add
+		}
+		if merged.Capabilities.Drop == nil {
+			merged.Capabilities.Drop = inject.Capabilities.Drop
+		}
+	}
+	if merged.Privileged == nil {
+		merged.Privileged = inject.Privileged
+	}
+	if merged.SELinuxOptions == nil {
+		merged.SELinuxOptions = inject.SELinuxOptions
+	}
+	if merged.RunAsUser == nil {
+		merged.RunAsUser = inject.RunAsUser
+	}
+	if merged.RunAsGroup == nil {
+		merged.RunAsGroup = inject.RunAsGroup
+	}
+	if merged.RunAsNonRoot == nil {
+		merged.RunAsNonRoot = inject.RunAsNonRoot
+	}
+	if merged.ReadOnlyRootFilesystem == nil {
+		merged.ReadOnlyRootFilesystem = inject.ReadOnlyRootFilesystem
+	}
+	if merged.AllowPrivilegeEscalation == nil {
+		merged.AllowPrivilegeEscalation = inject.AllowPrivilegeEscalation
+	}
+	if merged.ProcMount == nil {
+		merged.ProcMount = inject.ProcMount
+	}
+	return merged
+}
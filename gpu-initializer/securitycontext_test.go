@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+)
+
+func TestMergeSecurityContext(t *testing.T) {
+	boolPtr := func(b bool) *bool { return &b }
+	int64Ptr := func(i int64) *int64 { return &i }
+	inject := &corev1.SecurityContext{
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"SYS_ADMIN"}},
+		Privileged:               boolPtr(false),
+		RunAsUser:                int64Ptr(1000),
+		AllowPrivilegeEscalation: boolPtr(false),
+	}
+
+	tests := []struct {
+		name     string
+		existing *corev1.SecurityContext
+		want     *corev1.SecurityContext
+	}{
+		{
+			name: "takes the injected context without one",
+			want: inject,
+		},
+		{
+			name: "keeps the fields the container sets",
+			existing: &corev1.SecurityContext{
+				RunAsUser:              int64Ptr(0),
+				ReadOnlyRootFilesystem: boolPtr(true),
+			},
+			want: &corev1.SecurityContext{
+				Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"SYS_ADMIN"}},
+				Privileged:               boolPtr(false),
+				RunAsUser:                int64Ptr(0),
+				ReadOnlyRootFilesystem:   boolPtr(true),
+				AllowPrivilegeEscalation: boolPtr(false),
+			},
+		},
+		{
+			name: "merges the capabilities to add and to drop separately",
+			existing: &corev1.SecurityContext{
+				Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}},
+				Privileged:   boolPtr(true),
+			},
+			want: &corev1.SecurityContext{
+				Capabilities:             &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}, Drop: []corev1.Capability{"SYS_ADMIN"}},
+				Privileged:               boolPtr(true),
+				RunAsUser:                int64Ptr(1000),
+				AllowPrivilegeEscalation: boolPtr(false),
+			},
+		},
+		{
+			name: "keeps the capabilities the container drops",
+			existing: &corev1.SecurityContext{
+				Capabilities: &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+			},
+			want: &corev1.SecurityContext{
+				Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				Privileged:               boolPtr(false),
+				RunAsUser:                int64Ptr(1000),
+				AllowPrivilegeEscalation: boolPtr(false),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.existing.DeepCopy()
+			got := mergeSecurityContext(tt.existing, inject)
+			if !apiequality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("mergeSecurityContext() = %+v, want %+v", got, tt.want)
+			}
+			if !apiequality.Semantic.DeepEqual(tt.existing, original) {
+				t.Errorf("mergeSecurityContext() modified the existing context to %+v", tt.existing)
+			}
+			// The merged context must not share the injected one, the next container would see the changes.
+			*got.RunAsUser = 42
+			if *inject.RunAsUser != 1000 {
+				t.Errorf("mergeSecurityContext() returned a context sharing the injected one")
+			}
+		})
+	}
+}
+
+func TestInjectSecurityContextGpuContainer(t *testing.T) {
+	c := newTestConfig(t, `injectSecurityContext: {capabilities: {drop: ["SYS_ADMIN"]}}`)
+	got := mutateTestPod(t, c, newTestPod("app", newTestContainer("app"), newGpuContainer("cuda")))
+	if sc := got.Spec.Containers[0].SecurityContext; sc == nil || sc.Capabilities == nil || len(sc.Capabilities.Drop) != 1 {
+		t.Errorf("container app security context = %+v, want SYS_ADMIN dropped", sc)
+	}
+	if sc := got.Spec.Containers[1].SecurityContext; sc != nil {
+		t.Errorf("GPU container cuda security context = %+v, want none", sc)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inflightTracker counts the running pod handlers, so shutdown can wait for them to finish.
+type inflightTracker struct {
+	wg sync.WaitGroup
+	n  int64
+}
+
+func (t *inflightTracker) start() {
+	t.wg.Add(1)
+	atomic.AddInt64(&t.n, 1)
+}
+
+func (t *inflightTracker) done() {
+	atomic.AddInt64(&t.n, -1)
+	t.wg.Done()
+}
+
+// wait waits up to timeout for the running handlers and reports how many finished and how many were abandoned.
+func (t *inflightTracker) wait(timeout time.Duration) (drained, abandoned int64) {
+	pending := atomic.LoadInt64(&t.n)
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return pending, 0
+	case <-time.After(timeout):
+		abandoned = atomic.LoadInt64(&t.n)
+		if drained = pending - abandoned; drained < 0 {
+			drained = 0
+		}
+		return drained, abandoned
+	}
+}
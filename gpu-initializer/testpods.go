@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// testPodFiles prints, for -test-pods, whether the -config-file injects each pod YAML or JSON file in the directory
+// and the resulting env of the changed containers, and returns the exit code. Nothing is read from a cluster, so
+// ignoreNamespaceSelector is not evaluated.
+func testPodFiles(dir string) int {
+	if configFile == "" {
+		fmt.Fprintln(os.Stderr, "-test-pods requires -config-file")
+		return 2
+	}
+	c, err := loadConfig(context.Background(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	offline := *c
+	if offline.ignoreNamespaceSelector != nil {
+		fmt.Println("Note: ignoreNamespaceSelector needs the namespace labels from a cluster and is not evaluated")
+		offline.ignoreNamespaceSelector = nil
+	}
+
+	files, err := podFiles(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	code := 0
+	for _, file := range files {
+		if err := testPodFile(file, &offline); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// podFiles returns the YAML and JSON files in the directory, sorted by name.
+func podFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".yaml", ".yml", ".json":
+			if !e.IsDir() {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// testPodFile prints what the policy does with the pod of the file.
+func testPodFile(file string, c *config) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	pod := &corev1.Pod{}
+	if err := yaml.Unmarshal(bs, pod); err != nil {
+		return fmt.Errorf("invalid pod: %w", err)
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = corev1.NamespaceDefault
+	}
+
+	c = c.forNamespace(pod.Namespace).forPod(pod)
+	s, err := skipReason(context.Background(), pod, c, nil)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		fmt.Printf("%s: %s/%s skipped: %s\n", file, pod.Namespace, pod.Name, s.message)
+		return nil
+	}
+	mutatedPod, err := mutatePodSpec(pod, c)
+	if err != nil {
+		return err
+	}
+	containers := changedContainers(pod, mutatedPod)
+	if len(containers) == 0 {
+		fmt.Printf("%s: %s/%s unchanged, gpu=%t\n", file, pod.Namespace, pod.Name, isGpuPod(pod, c))
+		return nil
+	}
+	fmt.Printf("%s: %s/%s injected\n", file, pod.Namespace, pod.Name)
+	for _, container := range append(mutatedPod.Spec.InitContainers, mutatedPod.Spec.Containers...) {
+		if containsString(containers, container.Name) {
+			fmt.Printf("  %s: %s\n", container.Name, formatEnvs(container.Env))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// tracer records the pod processing spans. It is a no-op unless -enable-tracing sets up a tracer provider.
+var tracer = otel.Tracer("gpu-initializer")
+
+// setupTracing exports the spans to the OTLP/HTTP endpoint. The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(eventComponent))),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("gpu-initializer")
+	return provider.Shutdown, nil
+}
+
+// startPodSpan starts a span for processing the pod, with its name and namespace as attributes.
+func startPodSpan(ctx context.Context, name string, pod *corev1.Pod) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("pod", pod.Name),
+		attribute.String("namespace", pod.Namespace),
+	))
+}
+
+// endSpan records the error, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
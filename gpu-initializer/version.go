@@ -0,0 +1,8 @@
+package main
+
+// Set at build time with -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildDate=...", see build.
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
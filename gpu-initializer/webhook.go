@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// serveWebhook serves the mutating admission webhook over TLS on addr.
+func serveWebhook(addr, certFile, keyFile string, store *configStore, clientset kubernetes.Interface, inflight *inflightTracker) {
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", webhookHandler(store, clientset, inflight))
+
+	slog.Info("Serving the admission webhook", "addr", addr)
+	if err := http.ListenAndServeTLS(addr, certFile, keyFile, mux); err != nil {
+		fatal("Serving the admission webhook", "addr", addr, "error", err)
+	}
+}
+
+// webhookHandler decodes the AdmissionReview of a pod and responds with the injection as a JSON patch.
+func webhookHandler(store *configStore, clientset kubernetes.Interface, inflight *inflightTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inflight.start()
+		defer inflight.done()
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		review := admissionv1beta1.AdmissionReview{}
+		if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+			http.Error(w, "expected an AdmissionReview request", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = admitPod(r.Context(), review.Request, store.Load(), clientset)
+		review.Response.UID = review.Request.UID
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			slog.Error("Writing the admission response failed", "error", err)
+		}
+	}
+}
+
+// admitPod applies the injection policy to the pod of the admission request.
+// The pod is not modified by the webhook itself, the changes are returned as a JSON patch.
+// A pod the policy fails on, e.g. as a namespace lookup timed out, is admitted unmodified rather than
+// rejected, so a transient error doesn't block the pods of the cluster. Only an undecodable pod is rejected.
+func admitPod(ctx context.Context, req *admissionv1beta1.AdmissionRequest, c *config, clientset kubernetes.Interface) *admissionv1beta1.AdmissionResponse {
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		return admissionError(err)
+	}
+	// Pods created by controllers don't have their namespace set yet.
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	slog.Info("Admitting pod", "pod", pod.Name, "namespace", pod.Namespace)
+	podsProcessed.Inc()
+
+	mutatedPod := pod.DeepCopy()
+	result, err := injectPod(ctx, mutatedPod, c, clientset)
+	if err != nil {
+		slog.Error("Admitting pod failed, admitting it unmodified", "pod", pod.Name, "namespace", pod.Namespace, "error", err)
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	result.log(pod, "Admitted pod")
+
+	patch, err := createAdmissionPatch(req.Object.Raw, pod, mutatedPod, c)
+	if err != nil {
+		slog.Error("Creating the admission patch failed, admitting the pod unmodified", "pod", pod.Name, "namespace", pod.Namespace, "error", err)
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	checkPatchSize(pod, patch)
+	if dryRun {
+		slog.Info("Dry run: not mutating pod", "pod", pod.Name, "namespace", pod.Namespace, "action", "dry-run", "patch", string(patch))
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+	result.count(pod)
+
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+	}
+}
+
+// createAdmissionPatch returns the JSON patch that applies the changes from pod to mutatedPod to the raw object.
+// Diffing the decoded pods would patch by index against an object missing the fields unknown to this build:
+// prepending an init container would then shift its fields, e.g. the restartPolicy of a sidecar, onto the
+// injected one. The changes are taken as a strategic merge patch, which merges the containers by name,
+// applied to the raw object, and the JSON patch is diffed against the raw object the API server patches.
+func createAdmissionPatch(raw []byte, pod, mutatedPod *corev1.Pod, c *config) ([]byte, error) {
+	_, smp, err := createPatch(pod, mutatedPod, patchTypeStrategic, c.PreserveOverhead)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(raw, smp, corev1.Pod{})
+	if err != nil {
+		return nil, err
+	}
+	ops, err := jsonpatch.CreatePatch(raw, patched)
+	if err != nil {
+		return nil, err
+	}
+	// An empty patch is an empty list, not null.
+	if ops == nil {
+		ops = []jsonpatch.Operation{}
+	}
+	return json.Marshal(ops)
+}
+
+func admissionError(err error) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Result: &metav1.Status{Message: err.Error()},
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	evanjsonpatch "github.com/evanphx/json-patch"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// newAdmissionRequest returns the admission request creating the pod.
+func newAdmissionRequest(t *testing.T, pod *corev1.Pod) *admissionv1beta1.AdmissionRequest {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionv1beta1.AdmissionRequest{
+		Namespace: pod.Namespace,
+		Operation: admissionv1beta1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+func TestAdmitPod(t *testing.T) {
+	pod := newTestPod("app", newTestContainer("app"), newGpuContainer("cuda"))
+	pod.Initializers = nil
+	injected := pod.DeepCopy()
+	injected.Spec.Containers[0].Env = []corev1.EnvVar{{Name: defaultInjectEnvName, Value: defaultInjectEnvValue}}
+	gpuPod := newTestPod("gpu", newGpuContainer("cuda"))
+	gpuPod.Initializers = nil
+
+	tests := []struct {
+		name   string
+		config string
+		pod    *corev1.Pod
+		// The pod after the patch, nil when no patch must be returned.
+		want        *corev1.Pod
+		wantAllowed bool
+	}{
+		{
+			name:        "injects the containers without a GPU",
+			pod:         pod,
+			want:        injected,
+			wantAllowed: true,
+		},
+		{
+			name:        "returns an empty patch for a GPU pod",
+			pod:         gpuPod,
+			want:        gpuPod,
+			wantAllowed: true,
+		},
+		{
+			// The namespace of the pod doesn't exist in the fake clientset, so its lookup fails.
+			name: "admits the pod unmodified when the policy fails",
+			config: `
+ignoreNamespaceSelector:
+  matchLabels:
+    gpu: "true"
+`,
+			pod:         pod,
+			wantAllowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := admitPod(context.Background(), newAdmissionRequest(t, tt.pod), newTestConfig(t, tt.config), newTestClientset())
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("admitPod() allowed = %v, want %v: %v", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			if tt.want == nil {
+				if resp.Patch != nil {
+					t.Errorf("admitPod() patch = %s, want none", resp.Patch)
+				}
+				return
+			}
+			if resp.PatchType == nil || *resp.PatchType != admissionv1beta1.PatchTypeJSONPatch {
+				t.Errorf("admitPod() patch type = %v, want %s", resp.PatchType, admissionv1beta1.PatchTypeJSONPatch)
+			}
+			if got := applyJSONPatch(t, tt.pod, resp.Patch); !apiequality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("applying the patch %s gives %+v, want %+v", resp.Patch, got.Spec, tt.want.Spec)
+			}
+		})
+	}
+}
+
+func TestAdmitPodUndecodable(t *testing.T) {
+	req := &admissionv1beta1.AdmissionRequest{Object: runtime.RawExtension{Raw: []byte("{")}}
+	if resp := admitPod(context.Background(), req, newTestConfig(t, ""), newTestClientset()); resp.Allowed {
+		t.Errorf("admitPod() allowed an undecodable pod")
+	}
+}
+
+// TestAdmitPodUnknownFields checks the patch keeps the fields this build doesn't know on their container,
+// e.g. the restartPolicy of a native sidecar init container, when the injected init container is prepended.
+func TestAdmitPodUnknownFields(t *testing.T) {
+	raw := []byte(`{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {"name": "app", "namespace": "default"},
+  "spec": {
+    "initContainers": [{"name": "sidecar", "image": "proxy", "restartPolicy": "Always"}],
+    "containers": [{"name": "app", "image": "app", "resizePolicy": [{"resourceName": "cpu", "restartPolicy": "NotRequired"}]}]
+  }
+}`)
+	c := newTestConfig(t, `injectInitContainer: {name: "gpu-cleanup", image: "registry.example.com/gpu-cleanup:1.0"}`)
+	req := &admissionv1beta1.AdmissionRequest{Namespace: testNamespace, Operation: admissionv1beta1.Create, Object: runtime.RawExtension{Raw: raw}}
+
+	resp := admitPod(context.Background(), req, c, newTestClientset())
+	if !resp.Allowed {
+		t.Fatalf("admitPod() rejected the pod: %v", resp.Result)
+	}
+	ops, err := evanjsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatalf("decoding the JSON patch %s: %v", resp.Patch, err)
+	}
+	patched, err := ops.Apply(raw)
+	if err != nil {
+		t.Fatalf("applying the JSON patch %s: %v", resp.Patch, err)
+	}
+	got := struct {
+		Spec struct {
+			InitContainers []map[string]interface{} `json:"initContainers"`
+			Containers     []map[string]interface{} `json:"containers"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(patched, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(got.Spec.InitContainers); n != 2 {
+		t.Fatalf("the patched pod has %d init containers, want 2: %s", n, patched)
+	}
+	if cleanup := got.Spec.InitContainers[0]; cleanup["name"] != "gpu-cleanup" || cleanup["restartPolicy"] != nil {
+		t.Errorf("init container 0 = %v, want gpu-cleanup without a restartPolicy", cleanup)
+	}
+	if sidecar := got.Spec.InitContainers[1]; sidecar["name"] != "sidecar" || sidecar["restartPolicy"] != "Always" {
+		t.Errorf("init container 1 = %v, want sidecar keeping its restartPolicy", sidecar)
+	}
+	if app := got.Spec.Containers[0]; app["resizePolicy"] == nil || app["env"] == nil {
+		t.Errorf("container app = %v, want the inject env and its resizePolicy", app)
+	}
+}